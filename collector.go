@@ -0,0 +1,143 @@
+package ipfix
+
+import (
+	"net"
+	"sync"
+	"time"
+)
+
+// A Collector parses messages from any number of exporters, keeping a
+// separate Session (and thus template space) for each combination of
+// exporter address and Observation Domain ID. Sessions are created when the
+// first message arrives and are discarded once they have been idle for
+// longer than the idle timeout. A Collector is goroutine safe.
+type Collector struct {
+	opts        []Option
+	idleTimeout time.Duration
+	now         func() time.Time
+
+	mut       sync.Mutex
+	sessions  map[exporterKey]*exporterSession
+	lastSweep time.Time
+}
+
+type exporterKey struct {
+	addr     string
+	domainID uint32
+}
+
+type exporterSession struct {
+	session  *Session
+	lastSeen time.Time
+}
+
+// NewCollector creates a new Collector. Sessions that have not received a
+// message in idleTimeout are removed; an idleTimeout of zero disables
+// expiry. The options are passed to NewSession for every created Session.
+func NewCollector(idleTimeout time.Duration, opts ...Option) *Collector {
+	return &Collector{
+		opts:        opts,
+		idleTimeout: idleTimeout,
+		now:         time.Now,
+		sessions:    make(map[exporterKey]*exporterSession),
+	}
+}
+
+// ParseFrom extracts one message received from the given address, using the
+// Session belonging to that exporter and the message's Observation Domain.
+func (c *Collector) ParseFrom(addr net.Addr, bs []byte) (Message, error) {
+	// Invalid messages must not create a Session
+	hdr, _, _, err := splitMessage(bs)
+	if err != nil {
+		return Message{Header: hdr}, err
+	}
+
+	s := c.lookupSession(addr, hdr.DomainID)
+	return s.ParseBuffer(bs[:hdr.Length])
+}
+
+// ParseAllFrom extracts all the messages in a payload received from the given
+// address, as some exporters pack several messages into one UDP datagram.
+// Each message is parsed by the Session for its own Observation Domain.
+// Parsing stops at the first error, returning the messages parsed so far.
+func (c *Collector) ParseAllFrom(addr net.Addr, bs []byte) ([]Message, error) {
+	var msgs []Message
+	for len(bs) > 0 {
+		hdr, _, rest, err := splitMessage(bs)
+		if err != nil {
+			return msgs, err
+		}
+
+		s := c.lookupSession(addr, hdr.DomainID)
+		msg, err := s.ParseBuffer(bs[:len(bs)-len(rest)])
+		if err != nil {
+			return msgs, err
+		}
+		msgs = append(msgs, msg)
+		bs = rest
+	}
+	return msgs, nil
+}
+
+// Session returns the Session used for the given exporter address and
+// Observation Domain ID, or nil if there is none. Use it to create an
+// Interpreter for the records returned by ParseFrom.
+func (c *Collector) Session(addr net.Addr, domainID uint32) *Session {
+	c.mut.Lock()
+	defer c.mut.Unlock()
+	if es, ok := c.sessions[exporterKey{addr.String(), domainID}]; ok {
+		return es.session
+	}
+	return nil
+}
+
+// Expire removes all Sessions that have been idle for longer than the idle
+// timeout. This is done automatically as part of ParseFrom, but may be called
+// to release idle Sessions when no messages arrive at all.
+func (c *Collector) Expire() {
+	c.mut.Lock()
+	defer c.mut.Unlock()
+	c.expire(c.now())
+}
+
+func (c *Collector) lookupSession(addr net.Addr, domainID uint32) *Session {
+	key := exporterKey{addr.String(), domainID}
+	now := c.now()
+
+	c.mut.Lock()
+	defer c.mut.Unlock()
+
+	if c.idleTimeout > 0 && now.Sub(c.lastSweep) > c.idleTimeout/2 {
+		c.expire(now)
+	}
+
+	es, ok := c.sessions[key]
+	if !ok {
+		if debug {
+			dl.Printf("new session for %s/%d", key.addr, key.domainID)
+		}
+		es = &exporterSession{session: NewSession(c.opts...)}
+		es.session.now = c.now
+		es.session.exporter = addr
+		c.sessions[key] = es
+	}
+	es.lastSeen = now
+
+	return es.session
+}
+
+func (c *Collector) expire(now time.Time) {
+	c.lastSweep = now
+	if c.idleTimeout <= 0 {
+		return
+	}
+
+	for key, es := range c.sessions {
+		if now.Sub(es.lastSeen) > c.idleTimeout {
+			if debug {
+				dl.Printf("expiring session for %s/%d", key.addr, key.domainID)
+			}
+			delete(c.sessions, key)
+		}
+	}
+}
@@ -0,0 +1,135 @@
+package ipfix
+
+import (
+	"encoding/hex"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestCollectorSessionPerExporter(t *testing.T) {
+	t1, _ := hex.DecodeString("000a0020000000000000000000000001000200100100000200080004000c0004")
+	d1, _ := hex.DecodeString("000a001c0000000000000000000000010100000c0a0000010a000002")
+
+	a := &net.UDPAddr{IP: net.IP{192, 0, 2, 1}, Port: 4739}
+	b := &net.UDPAddr{IP: net.IP{192, 0, 2, 2}, Port: 4739}
+
+	c := NewCollector(0)
+
+	if _, err := c.ParseFrom(a, t1); err != nil {
+		t.Fatal("ParseFrom failed", err)
+	}
+
+	msg, err := c.ParseFrom(a, d1)
+	if err != nil {
+		t.Fatal("ParseFrom failed", err)
+	}
+	if len(msg.DataRecords) != 1 {
+		t.Error("Incorrect number of data records", len(msg.DataRecords))
+	}
+
+	// The template was sent by a, so b can't use it
+	msg, err = c.ParseFrom(b, d1)
+	if err != nil {
+		t.Fatal("ParseFrom failed", err)
+	}
+	if len(msg.DataRecords) != 0 {
+		t.Error("Incorrect number of data records", len(msg.DataRecords))
+	}
+
+	if c.Session(a, 1) == c.Session(b, 1) {
+		t.Error("Exporters share a session")
+	}
+	if c.Session(a, 2) != nil {
+		t.Error("Unexpected session for unseen domain")
+	}
+}
+
+func TestCollectorParseAll(t *testing.T) {
+	t1, _ := hex.DecodeString("000a0020000000000000000000000001000200100100000200080004000c0004")
+	d1, _ := hex.DecodeString("000a001c0000000000000000000000010100000c0a0000010a000002")
+	t2, _ := hex.DecodeString("000a001c0000000000000000000000020002000c0100000100080004")
+	d2, _ := hex.DecodeString("000a0018000000000000000000000002010000080a000003")
+
+	a := &net.UDPAddr{IP: net.IP{192, 0, 2, 1}, Port: 4739}
+
+	// Messages for two domains packed into one datagram
+	var payload []byte
+	for _, bs := range [][]byte{t1, t2, d1, d2} {
+		payload = append(payload, bs...)
+	}
+
+	c := NewCollector(0)
+	msgs, err := c.ParseAllFrom(a, payload)
+	if err != nil {
+		t.Fatal("ParseAllFrom failed", err)
+	}
+	if len(msgs) != 4 {
+		t.Fatal("Incorrect number of messages", len(msgs))
+	}
+	for i, n := range []int{0, 0, 1, 1} {
+		if len(msgs[i].DataRecords) != n {
+			t.Errorf("Incorrect number of data records %d in message %d", len(msgs[i].DataRecords), i)
+		}
+	}
+	if len(msgs[3].DataRecords) == 1 && len(msgs[3].DataRecords[0].Fields) != 1 {
+		t.Error("Record of domain 2 decoded with the template of domain 1")
+	}
+	if c.Session(a, 1) == nil || c.Session(a, 2) == nil || c.Session(a, 1) == c.Session(a, 2) {
+		t.Error("Incorrect sessions for the domains")
+	}
+
+	// Trailing garbage
+	msgs, err = c.ParseAllFrom(a, append(d1, 0, 10))
+	if err != io.ErrUnexpectedEOF {
+		t.Errorf("Received %v instead of io.ErrUnexpectedEOF error", err)
+	}
+	if len(msgs) != 1 {
+		t.Error("Incorrect number of messages", len(msgs))
+	}
+}
+
+func TestCollectorInvalidMessage(t *testing.T) {
+	a := &net.UDPAddr{IP: net.IP{192, 0, 2, 1}, Port: 4739}
+	c := NewCollector(0)
+
+	// Wrong version, and a length exceeding the datagram
+	bad, _ := hex.DecodeString("00090010000000000000000000000001")
+	if _, err := c.ParseFrom(a, bad); err != ErrVersion {
+		t.Errorf("Received %v instead of ErrVersion error", err)
+	}
+	bad, _ = hex.DecodeString("000a0020000000000000000000000002")
+	if _, err := c.ParseFrom(a, bad); err != io.ErrUnexpectedEOF {
+		t.Errorf("Received %v instead of io.ErrUnexpectedEOF error", err)
+	}
+
+	if len(c.sessions) != 0 {
+		t.Error("Incorrect number of sessions", len(c.sessions))
+	}
+}
+
+func TestCollectorExpiry(t *testing.T) {
+	t1, _ := hex.DecodeString("000a0020000000000000000000000001000200100100000200080004000c0004")
+	a := &net.UDPAddr{IP: net.IP{192, 0, 2, 1}, Port: 4739}
+
+	now := time.Date(2016, 1, 1, 0, 0, 0, 0, time.UTC)
+	c := NewCollector(time.Minute)
+	c.now = func() time.Time { return now }
+
+	if _, err := c.ParseFrom(a, t1); err != nil {
+		t.Fatal("ParseFrom failed", err)
+	}
+
+	now = now.Add(30 * time.Second)
+	c.Expire()
+	if c.Session(a, 1) == nil {
+		t.Error("Session expired too early")
+	}
+
+	now = now.Add(2 * time.Minute)
+	c.Expire()
+	if c.Session(a, 1) != nil {
+		t.Error("Session did not expire")
+	}
+}
@@ -0,0 +1,321 @@
+package ipfix
+
+import "sync/atomic"
+
+// A RecordCursor walks the data records of a message one at a time, without
+// building a Message. Template sets are registered with the Session as they
+// are encountered, data sets are decoded one record at a time. The fields of
+// the records returned by a RecordCursor are slices of the parsed buffer, as
+// for ParseBufferNoCopy, and the slice holding them is reused between
+// records.
+//
+// The sequence number check needs the number of records in the whole
+// message, and templates may follow the data sets. A caller that stops
+// before Next returns false must call Finish to walk the rest of the message;
+// otherwise templates are missed and the next message from the domain is
+// reported as a gap.
+//
+//	c := s.Records(buf)
+//	for c.Next() {
+//	    if c.TemplateID() != interesting {
+//	        c.SkipSet()
+//	        continue
+//	    }
+//	    rec := c.Record()
+//	    // handle rec
+//	}
+//	if err := c.Err(); err != nil {
+//	    // handle err
+//	}
+type RecordCursor struct {
+	s   *Session
+	hdr MessageHeader
+	err error
+
+	sets    slice // remaining sets of the message
+	records slice // remaining records of the current set
+
+	size      int    // length of the message
+	setOffset int    // offset of the current set in the message
+	setSize   int    // length of the current set data
+	setID     uint16 // ID of the current set
+	index     int    // index of the current record in the set
+
+	tpl    *template
+	tid    uint16
+	fields [][]byte
+
+	recovered []recoveredRecord
+	current   *recoveredRecord
+
+	withdrawals []TemplateWithdrawal
+	violations  []TemplateViolation
+
+	count       int // records in the message, for the sequence check
+	unknownSets int
+	done        bool
+	sequence    SequenceCheck
+}
+
+type recoveredRecord struct {
+	rec DataRecord
+	tpl *template
+}
+
+// Records returns a RecordCursor for the message in bs. As for ParseBuffer,
+// the message header is validated and bytes following the message are
+// ignored. The caller must not modify or reuse bs while the cursor or the
+// records it returned are in use.
+func (s *Session) Records(bs []byte) RecordCursor {
+	var c RecordCursor
+	c.s = s
+	c.Reset(bs)
+	return c
+}
+
+// Reset prepares the cursor to walk the message in bs, reusing the storage
+// allocated for the previous message. It does not Finish the previous
+// message.
+func (c *RecordCursor) Reset(bs []byte) {
+	*c = RecordCursor{
+		s:           c.s,
+		fields:      c.fields[:0],
+		recovered:   c.recovered[:0],
+		withdrawals: c.withdrawals[:0],
+		violations:  c.violations[:0],
+	}
+
+	hdr, body, _, err := splitMessage(bs)
+	c.hdr = hdr
+	c.sets = slice{bs: body}
+	c.size = msgHeaderLength + len(body)
+	c.s.expire()
+	if err != nil {
+		c.fail(err)
+		return
+	}
+	c.s.stats.countMessage(hdr)
+}
+
+// Header returns the header of the message.
+func (c *RecordCursor) Header() MessageHeader {
+	return c.hdr
+}
+
+// Next advances the cursor to the next data record, returning false when
+// there are no more records or an error occurred.
+func (c *RecordCursor) Next() bool {
+	if c.current != nil {
+		// The template of the recovered record doesn't describe the
+		// remains of the template set it was recovered by.
+		c.current = nil
+		c.tpl = nil
+	}
+
+	for c.err == nil && !c.done {
+		if len(c.recovered) > 0 {
+			// Records from buffered data sets whose template just arrived
+			c.current = &c.recovered[0]
+			c.recovered = c.recovered[1:]
+			c.tpl = c.current.tpl
+			c.tid = c.current.rec.TemplateID
+			return true
+		}
+
+		if c.tpl != nil && c.records.Len() > 0 && c.records.Len() >= int(c.tpl.minRecord) {
+			c.count++
+			c.index++
+			if !c.decode() {
+				return false
+			}
+			c.s.stats.countRecord(c.tpl)
+			return true
+		}
+
+		c.nextSet()
+	}
+
+	return false
+}
+
+// SkipSet skips the remaining records of the current data set. The next call
+// to Next moves to the following set.
+func (c *RecordCursor) SkipSet() {
+	for c.err == nil && c.tpl != nil && c.current == nil && c.records.Len() > 0 && c.records.Len() >= int(c.tpl.minRecord) {
+		c.count++
+		c.index++
+		if c.decode() {
+			c.s.stats.countRecord(c.tpl)
+		}
+	}
+	c.endSet()
+}
+
+// Finish walks the remaining sets of the message, registering any templates
+// and counting the records for the sequence number check without returning
+// them. It returns the error that stopped the walk, if any, like Err.
+func (c *RecordCursor) Finish() error {
+	c.recovered = c.recovered[:0]
+	if c.current != nil {
+		c.current = nil
+		c.tpl = nil
+	}
+	for c.err == nil && !c.done {
+		c.SkipSet()
+		c.nextSet()
+	}
+	return c.err
+}
+
+// TemplateID returns the template ID of the current record. With ID aliasing
+// this is the virtual template ID.
+func (c *RecordCursor) TemplateID() uint16 {
+	return c.tid
+}
+
+// Template returns the field specifiers of the current record's template.
+// For options templates the scope fields come first.
+func (c *RecordCursor) Template() []TemplateFieldSpecifier {
+	return c.tpl.specifiers
+}
+
+// Options returns true if the current record is described by an options
+// template.
+func (c *RecordCursor) Options() bool {
+	return c.tpl.scopeFields > 0
+}
+
+// Record returns the current record. For options records the scope fields
+// come first in Fields; use OptionsRecord to have them separated. The Fields
+// slice is valid until the next call to Next.
+func (c *RecordCursor) Record() DataRecord {
+	if c.current != nil {
+		return c.current.rec
+	}
+	return DataRecord{
+		DomainID:   c.hdr.DomainID,
+		TemplateID: c.tid,
+		Fields:     c.fields,
+	}
+}
+
+// OptionsRecord returns the current record, which must be described by an
+// options template.
+func (c *RecordCursor) OptionsRecord() OptionsDataRecord {
+	rec := c.Record()
+	return OptionsDataRecord{
+		DomainID:    rec.DomainID,
+		TemplateID:  rec.TemplateID,
+		ScopeFields: rec.Fields[:c.tpl.scopeFields:c.tpl.scopeFields],
+		Fields:      rec.Fields[c.tpl.scopeFields:],
+	}
+}
+
+// Err returns the error that stopped the iteration, if any.
+func (c *RecordCursor) Err() error {
+	return c.err
+}
+
+// Withdrawals returns the template withdrawals in the template sets walked so
+// far, as Message.Withdrawals.
+func (c *RecordCursor) Withdrawals() []TemplateWithdrawal {
+	return c.withdrawals
+}
+
+// TemplateViolations returns the problems found by WithTemplateValidation in
+// the template sets walked so far, as Message.TemplateViolations.
+func (c *RecordCursor) TemplateViolations() []TemplateViolation {
+	return c.violations
+}
+
+// Sequence returns the result of the sequence number check for the message.
+// The check is performed once all records have been walked.
+func (c *RecordCursor) Sequence() SequenceCheck {
+	return c.sequence
+}
+
+// decode reads the fields of the next record of the set, returning false if
+// the record exceeds the set.
+func (c *RecordCursor) decode() bool {
+	offset := c.setSize - c.records.Len()
+	var err error
+	c.fields, err = c.s.readFields(&c.records, c.tpl.specifiers, c.fields[:0])
+	if err != nil {
+		err = recordError(err, offset, c.setID, c.index-1, "data record exceeds set")
+		c.fail(setError(err, c.setOffset, c.setID, ""))
+		return false
+	}
+	return true
+}
+
+func (c *RecordCursor) nextSet() {
+	c.endSet()
+
+	if c.sets.Len() == 0 {
+		c.done = true
+		c.sequence = c.s.sequences.check(c.hdr, c.count, c.unknownSets == 0)
+		return
+	}
+
+	c.setOffset = c.size - c.sets.Len()
+	c.index = 0
+
+	setHdr, set, err := cutSet(&c.sets, c.setOffset)
+	c.setID = setHdr.SetID
+	if err != nil {
+		c.fail(err)
+		return
+	}
+	c.setSize = len(set)
+	c.records = slice{bs: set}
+	c.s.stats.countSet(setHdr.SetID)
+
+	if setHdr.SetID < 256 {
+		// Template sets are handled as usual, as the templates are needed
+		// for the data sets that follow.
+		msg := Message{Header: c.hdr, noCopy: true}
+		if err := c.s.readSet(setHdr, &c.records, &msg); err != nil {
+			c.fail(setError(err, c.setOffset, setHdr.SetID, "reserved set ID"))
+			return
+		}
+		c.s.stats.countRecords(&msg)
+		c.withdrawals = append(c.withdrawals, msg.Withdrawals...)
+		c.violations = append(c.violations, msg.TemplateViolations...)
+		for _, rec := range msg.DataRecords {
+			c.recover(rec)
+		}
+		for _, rec := range msg.OptionsDataRecords {
+			fields := make([][]byte, 0, len(rec.ScopeFields)+len(rec.Fields))
+			fields = append(fields, rec.ScopeFields...)
+			fields = append(fields, rec.Fields...)
+			c.recover(DataRecord{DomainID: rec.DomainID, TemplateID: rec.TemplateID, Fields: fields})
+		}
+		return
+	}
+
+	c.tpl, c.tid = c.s.dataSetTemplate(templateKey{c.hdr.DomainID, setHdr.SetID}, set)
+	if c.tpl == nil {
+		c.unknownSets++
+	}
+}
+
+// endSet leaves the current data set, counting any remaining padding.
+func (c *RecordCursor) endSet() {
+	if c.tpl != nil && c.current == nil && c.records.Len() > 0 {
+		atomic.AddUint64(&c.s.stats.paddingBytes, uint64(c.records.Len()))
+	}
+	c.tpl = nil
+}
+
+func (c *RecordCursor) fail(err error) {
+	c.err = err
+	c.s.stats.countError(err)
+}
+
+func (c *RecordCursor) recover(rec DataRecord) {
+	tpl := c.s.lookupRecordTemplate(rec.DomainID, rec.TemplateID)
+	if tpl == nil {
+		return
+	}
+	c.recovered = append(c.recovered, recoveredRecord{rec, tpl})
+}
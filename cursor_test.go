@@ -0,0 +1,191 @@
+package ipfix_test
+
+import (
+	"encoding/hex"
+	"errors"
+	"reflect"
+	"testing"
+
+	"github.com/calmh/ipfix"
+)
+
+func TestRecordCursor(t *testing.T) {
+	packet, _ := hex.DecodeString("000a00405685b3700000000000bc614e000200140100000300080004000c0004000200040100001cc0a800c9c0a80001000000ebc0a800cac0a800010000002a")
+
+	msg, err := ipfix.NewSession().ParseBuffer(packet)
+	if err != nil {
+		t.Fatal("ParseBuffer failed", err)
+	}
+
+	p := ipfix.NewSession()
+	c := p.Records(packet)
+	var n int
+	for c.Next() {
+		if c.TemplateID() != 256 {
+			t.Error("Incorrect template ID", c.TemplateID())
+		}
+		if c.Options() {
+			t.Error("Unexpected options record")
+		}
+		if len(c.Template()) != 3 {
+			t.Error("Incorrect number of field specifiers", len(c.Template()))
+		}
+		if rec := c.Record(); !reflect.DeepEqual(rec, msg.DataRecords[n]) {
+			t.Errorf("Record %d differs: %v != %v", n, rec, msg.DataRecords[n])
+		}
+		n++
+	}
+	if err := c.Err(); err != nil {
+		t.Fatal("Cursor failed", err)
+	}
+	if n != 2 {
+		t.Error("Incorrect number of data records", n)
+	}
+	if c.Header() != msg.Header {
+		t.Errorf("Incorrect header %v", c.Header())
+	}
+	if c.Sequence().Status != ipfix.SequenceUnknown {
+		t.Error("Incorrect sequence status", c.Sequence().Status)
+	}
+}
+
+func TestRecordCursorSkipSet(t *testing.T) {
+	packet, _ := hex.DecodeString("000a00405685b3700000000000bc614e000200140100000300080004000c0004000200040100001cc0a800c9c0a80001000000ebc0a800cac0a800010000002a")
+
+	p := ipfix.NewSession()
+	c := p.Records(packet)
+	var n int
+	for c.Next() {
+		c.SkipSet()
+		n++
+	}
+	if err := c.Err(); err != nil {
+		t.Fatal("Cursor failed", err)
+	}
+	if n != 1 {
+		t.Error("Incorrect number of data records", n)
+	}
+
+	// Skipped records still count towards the sequence number
+	packet[11] = 2 // sequence number
+	c.Reset(packet)
+	for c.Next() {
+		c.SkipSet()
+	}
+	if c.Sequence().Status != ipfix.SequenceOK {
+		t.Error("Incorrect sequence status", c.Sequence().Status)
+	}
+}
+
+func TestRecordCursorFinish(t *testing.T) {
+	// Template 256, then two records of 256 followed by template 257, then
+	// one record with sequence number 2.
+	t1, _ := hex.DecodeString("000a001c0000000000000000000000010002000c0100000100080004")
+	d1, _ := hex.DecodeString("000a00280000000000000000000000010100000c0a0000010a0000020002000c0101000100070002")
+	d2, _ := hex.DecodeString("000a0018000000000000000200000001010000080a000003")
+
+	p := ipfix.NewSession()
+	c := p.Records(t1)
+	if err := c.Finish(); err != nil {
+		t.Fatal("Finish failed", err)
+	}
+
+	// Stop after the first record
+	c.Reset(d1)
+	if !c.Next() {
+		t.Fatal("Next failed", c.Err())
+	}
+	if err := c.Finish(); err != nil {
+		t.Fatal("Finish failed", err)
+	}
+	if c.Next() {
+		t.Error("Unexpected record after Finish")
+	}
+	if _, ok := p.Template(1, 257); !ok {
+		t.Error("Template following the data set not registered")
+	}
+
+	c.Reset(d2)
+	for c.Next() {
+	}
+	if c.Sequence().Status != ipfix.SequenceOK {
+		t.Errorf("Incorrect sequence status %v", c.Sequence())
+	}
+	if n := p.Stats().DataRecords; n != 3 {
+		t.Error("Incorrect number of data records", n)
+	}
+}
+
+func TestRecordCursorTruncated(t *testing.T) {
+	// The second record claims a ten byte interface name, with three bytes
+	// left in the set.
+	packet, _ := hex.DecodeString("000a00270000000000000000000000010002000c010100010052ffff0101000b0261620a616263")
+
+	c := ipfix.NewSession().Records(packet)
+	var n int
+	for c.Next() {
+		if rec := c.Record(); string(rec.Fields[0]) != "ab" {
+			t.Errorf("Incorrect record %q", rec.Fields)
+		}
+		n++
+	}
+	if n != 1 {
+		t.Error("Incorrect number of data records", n)
+	}
+	if !errors.Is(c.Err(), ipfix.ErrRead) {
+		t.Errorf("Received %v instead of ipfix.ErrRead error", c.Err())
+	}
+}
+
+func TestRecordCursorOptions(t *testing.T) {
+	packet, _ := hex.DecodeString("000a003800000000000000000000000100030018010000030001009500040022000400230001000001000010000000010000006401000000")
+
+	p := ipfix.NewSession()
+	c := p.Records(packet)
+	var n int
+	for c.Next() {
+		if !c.Options() {
+			t.Error("Expected options record")
+		}
+		rec := c.OptionsRecord()
+		if len(rec.ScopeFields) != 1 || len(rec.Fields) != 2 {
+			t.Errorf("Incorrect number of fields %d+%d", len(rec.ScopeFields), len(rec.Fields))
+		}
+		// Appending to the scope fields must not overwrite the fields
+		field := rec.Fields[0]
+		_ = append(rec.ScopeFields, nil)
+		if rec.Fields[0] == nil || &rec.Fields[0][0] != &field[0] {
+			t.Error("Scope fields share capacity with fields")
+		}
+		n++
+	}
+	if err := c.Err(); err != nil {
+		t.Fatal("Cursor failed", err)
+	}
+	if n != 1 {
+		t.Error("Incorrect number of data records", n)
+	}
+}
+
+func TestRecordCursorAllocs(t *testing.T) {
+	packet, _ := hex.DecodeString("000a00405685b3700000000000bc614e000200140100000300080004000c0004000200040100001cc0a800c9c0a80001000000ebc0a800cac0a800010000002a")
+	data, _ := hex.DecodeString("000a002c5685b3700000000000bc614e0100001cc0a800c9c0a80001000000ebc0a800cac0a800010000002a")
+
+	p := ipfix.NewSession()
+	c := p.Records(packet)
+	for c.Next() {
+	}
+
+	allocs := testing.AllocsPerRun(100, func() {
+		c.Reset(data)
+		for c.Next() {
+			c.Record()
+		}
+		if c.Err() != nil {
+			t.Fatal("Cursor failed", c.Err())
+		}
+	})
+	if allocs != 0 {
+		t.Error("Unexpected allocations", allocs)
+	}
+}
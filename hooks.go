@@ -0,0 +1,96 @@
+package ipfix
+
+import "net"
+
+// TemplateEventKind is the kind of change a TemplateEvent reports.
+type TemplateEventKind int
+
+const (
+	// TemplateAdded is reported when a template ID is first defined.
+	TemplateAdded TemplateEventKind = iota
+	// TemplateChanged is reported when a template ID is redefined with a
+	// different layout. Refreshes of an unchanged template are not reported.
+	TemplateChanged
+	// TemplateWithdrawn is reported when the exporter withdraws a template.
+	TemplateWithdrawn
+	// TemplateExpired is reported when a template passes the template
+	// timeout without being refreshed.
+	TemplateExpired
+	// TemplateRejected is reported when a template fails validation with
+	// ValidateReject. Old is the previous definition it removed, if any.
+	TemplateRejected
+)
+
+func (k TemplateEventKind) String() string {
+	switch k {
+	case TemplateAdded:
+		return "added"
+	case TemplateChanged:
+		return "changed"
+	case TemplateWithdrawn:
+		return "withdrawn"
+	case TemplateExpired:
+		return "expired"
+	case TemplateRejected:
+		return "rejected"
+	default:
+		return "invalid"
+	}
+}
+
+// A TemplateEvent describes a change to the templates of a Session. Old is
+// nil for TemplateAdded, New is nil for TemplateWithdrawn, TemplateExpired and
+// TemplateRejected.
+// Alias and ScopeFieldCount describe the New template when there is one, and
+// the Old template otherwise.
+type TemplateEvent struct {
+	Kind            TemplateEventKind
+	Exporter        net.Addr // The exporter, for Sessions created by a Collector
+	DomainID        uint32
+	TemplateID      uint16 // The template ID used by the exporter
+	Alias           uint16 // The virtual template ID, when ID aliasing is enabled
+	ScopeFieldCount uint16 // Nonzero for options templates
+	Old             []TemplateFieldSpecifier
+	New             []TemplateFieldSpecifier
+}
+
+// WithTemplateHook registers a function to be called whenever a template is
+// added, changed, withdrawn, expired or rejected. The function is called synchronously
+// from the goroutine parsing the message that caused the change, and must not
+// parse messages on the same Session. Several hooks may be registered.
+func WithTemplateHook(fn func(TemplateEvent)) Option {
+	return func(s *Session) {
+		s.hooks = append(s.hooks, fn)
+	}
+}
+
+func (s *Session) templateEvent(kind TemplateEventKind, key templateKey, old, new *template) {
+	if len(s.hooks) == 0 {
+		return
+	}
+
+	ev := TemplateEvent{
+		Kind:       kind,
+		Exporter:   s.exporter,
+		DomainID:   key.domainID,
+		TemplateID: key.templateID,
+	}
+	if old != nil {
+		ev.Old = old.specifiers
+		ev.Alias = old.alias
+		ev.ScopeFieldCount = old.scopeFields
+	}
+	if new != nil {
+		ev.New = new.specifiers
+		ev.Alias = new.alias
+		ev.ScopeFieldCount = new.scopeFields
+	}
+
+	if debug {
+		dl.Printf("template %d/%d %v", key.domainID, key.templateID, kind)
+	}
+
+	for _, fn := range s.hooks {
+		fn(ev)
+	}
+}
@@ -0,0 +1,47 @@
+package ipfix
+
+import (
+	"encoding/hex"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestTemplateHooks(t *testing.T) {
+	t1, _ := hex.DecodeString("000a0020000000000000000000000001000200100100000200080004000c0004")
+	t2, _ := hex.DecodeString("000a001c0000000000000000000000010002000c0100000100070002")
+	w256, _ := hex.DecodeString("000a00180000000000000000000000010002000801000000")
+
+	var events []TemplateEvent
+	now := time.Date(2016, 1, 1, 0, 0, 0, 0, time.UTC)
+	s := NewSession(WithTemplateTimeout(time.Minute), WithTemplateHook(func(ev TemplateEvent) {
+		events = append(events, ev)
+	}))
+	s.now = func() time.Time { return now }
+
+	// Added, refreshed, changed, withdrawn, added
+	for _, bs := range [][]byte{t1, t1, t2, w256, t1} {
+		if _, err := s.ParseBuffer(bs); err != nil {
+			t.Fatal("ParseBuffer failed", err)
+		}
+	}
+
+	// Expired
+	now = now.Add(2 * time.Minute)
+	if _, err := s.ParseBuffer(w256); err != nil {
+		t.Fatal("ParseBuffer failed", err)
+	}
+
+	tpl1 := []TemplateFieldSpecifier{{FieldID: 8, Length: 4}, {FieldID: 12, Length: 4}}
+	tpl2 := []TemplateFieldSpecifier{{FieldID: 7, Length: 2}}
+	exp := []TemplateEvent{
+		{Kind: TemplateAdded, DomainID: 1, TemplateID: 256, New: tpl1},
+		{Kind: TemplateChanged, DomainID: 1, TemplateID: 256, Old: tpl1, New: tpl2},
+		{Kind: TemplateWithdrawn, DomainID: 1, TemplateID: 256, Old: tpl2},
+		{Kind: TemplateAdded, DomainID: 1, TemplateID: 256, New: tpl1},
+		{Kind: TemplateExpired, DomainID: 1, TemplateID: 256, Old: tpl1},
+	}
+	if !reflect.DeepEqual(events, exp) {
+		t.Errorf("Incorrect events\n%+v !=\n%+v", events, exp)
+	}
+}
@@ -7,20 +7,23 @@ import (
 	"math"
 	"net"
 	"os"
+	"sync/atomic"
 	"time"
 )
 
 // Interpreter provides translation between the raw bytes of a DataRecord
 // and the actual values as specified by the corresponding template.
 type Interpreter struct {
-	dictionary fieldDictionary
-	session    *Session
+	dictionary       fieldDictionary
+	session          *Session
+	legacyTimestamps bool
 }
 
 // FieldType is the IPFIX type of an Information Element ("Field").
 type FieldType int
 
-// The available field types as defined by RFC 5102.
+// The available field types as defined by RFC 5102, and the structured data
+// types defined by RFC 6313.
 const (
 	Unknown FieldType = iota
 	Uint8
@@ -43,6 +46,9 @@ const (
 	DateTimeNanoseconds
 	Ipv4Address
 	Ipv6Address
+	BasicList
+	SubTemplateList
+	SubTemplateMultiList
 )
 
 // FieldTypes maps string representations of field types into their
@@ -68,6 +74,9 @@ var FieldTypes = map[string]FieldType{
 	"dateTimeNanoseconds":  DateTimeNanoseconds,
 	"ipv4Address":          Ipv4Address,
 	"ipv6Address":          Ipv6Address,
+	"basicList":            BasicList,
+	"subTemplateList":      SubTemplateList,
+	"subTemplateMultiList": SubTemplateMultiList,
 }
 
 // minLength is the minimum length of a field of the given type, in bytes.
@@ -75,9 +84,9 @@ func (t FieldType) minLength() int {
 	switch t {
 	case Uint8, Int8, Boolean, Uint16, Int16, Uint32, Int32, Uint64, Int64:
 		return 1 // all integers can be reduced-size encoded
-	case Float32, DateTimeSeconds:
-		return 4
-	case Float64, DateTimeMilliseconds, DateTimeMicroseconds, DateTimeNanoseconds:
+	case Float32, Float64, DateTimeSeconds:
+		return 4 // float64 can be reduced-size encoded as float32
+	case DateTimeMilliseconds, DateTimeMicroseconds, DateTimeNanoseconds:
 		return 8
 	case MacAddress:
 		return 6
@@ -85,6 +94,12 @@ func (t FieldType) minLength() int {
 		return 4
 	case Ipv6Address:
 		return 16
+	case BasicList:
+		return 5 // semantic, field ID and element length
+	case SubTemplateList:
+		return 3 // semantic and template ID
+	case SubTemplateMultiList:
+		return 1 // semantic
 	default:
 		return 0
 	}
@@ -131,9 +146,29 @@ type InterpretedTemplateFieldSpecifier struct {
 	TemplateFieldSpecifier
 }
 
+// An InterpreterOption is an option for NewInterpreter.
+type InterpreterOption func(*Interpreter)
+
+// WithLegacyTimestamps enables or disables interpreting dateTimeMicroseconds
+// and dateTimeNanoseconds fields as 64 bit counts since the Unix epoch, as
+// some exporters send them, instead of as the NTP timestamps defined by RFC
+// 7011. The default is disabled.
+func WithLegacyTimestamps(v bool) InterpreterOption {
+	return func(i *Interpreter) {
+		i.legacyTimestamps = v
+	}
+}
+
 // NewInterpreter craets a new Interpreter based on the specified Session.
-func NewInterpreter(s *Session) *Interpreter {
-	return &Interpreter{builtinDictionary, s}
+func NewInterpreter(s *Session, opts ...InterpreterOption) *Interpreter {
+	i := &Interpreter{
+		dictionary: builtinDictionary,
+		session:    s,
+	}
+	for _, opt := range opts {
+		opt(i)
+	}
+	return i
 }
 
 // Interpret a raw DataRecord into a list of InterpretedFields.
@@ -144,28 +179,51 @@ func (i *Interpreter) Interpret(rec DataRecord) []InterpretedField {
 // InterpretInto interprets a raw DataRecord into an existing slice of
 // InterpretedFields. If the slice is not long enough it will be reallocated.
 func (i *Interpreter) InterpretInto(rec DataRecord, fieldList []InterpretedField) []InterpretedField {
-	tpl := i.session.lookupTemplateFieldSpecifiers(rec.TemplateID)
-	if tpl == nil {
+	tpl := i.session.lookupRecordTemplate(rec.DomainID, rec.TemplateID)
+	if tpl == nil || len(tpl.specifiers) != len(rec.Fields) {
 		return nil
 	}
 
+	return i.interpretFields(tpl.specifiers, rec.Fields, fieldList, listContext{domainID: rec.DomainID})
+}
+
+// InterpretOptions interprets a raw OptionsDataRecord into a list of
+// InterpretedFields for the scope fields and another for the option fields.
+func (i *Interpreter) InterpretOptions(rec OptionsDataRecord) (scopeList, fieldList []InterpretedField) {
+	tpl := i.session.lookupRecordTemplate(rec.DomainID, rec.TemplateID)
+	if tpl == nil || int(tpl.scopeFields) != len(rec.ScopeFields) || len(tpl.specifiers) != len(rec.ScopeFields)+len(rec.Fields) {
+		return nil, nil
+	}
+
+	ctx := listContext{domainID: rec.DomainID}
+	scopeList = i.interpretFields(tpl.specifiers[:tpl.scopeFields], rec.ScopeFields, nil, ctx)
+	fieldList = i.interpretFields(tpl.specifiers[tpl.scopeFields:], rec.Fields, nil, ctx)
+	return scopeList, fieldList
+}
+
+func (i *Interpreter) interpretFields(tpl []TemplateFieldSpecifier, fields [][]byte, fieldList []InterpretedField, ctx listContext) []InterpretedField {
 	if len(fieldList) < len(tpl) {
 		fieldList = make([]InterpretedField, len(tpl))
 	} else {
 		fieldList = fieldList[:len(tpl)]
 	}
 
+	var unknown uint64
 	for j, field := range tpl {
 		fieldList[j].FieldID = field.FieldID
 		fieldList[j].EnterpriseID = field.EnterpriseID
 
 		if entry, ok := i.dictionary[dictionaryKey{field.EnterpriseID, field.FieldID}]; ok {
 			fieldList[j].Name = entry.Name
-			fieldList[j].Value = interpretBytes(&rec.Fields[j], entry.Type)
+			fieldList[j].Value = i.interpretValue(&fields[j], entry.Type, ctx)
 		} else {
-			fieldList[j].RawValue = rec.Fields[j]
+			fieldList[j].RawValue = fields[j]
+			unknown++
 		}
 	}
+	if unknown > 0 {
+		atomic.AddUint64(&i.session.stats.unknownFields, unknown)
+	}
 
 	return fieldList
 }
@@ -186,6 +244,16 @@ func (i *Interpreter) InterpretTemplate(rec TemplateRecord) []InterpretedTemplat
 	return fieldList
 }
 
+// InterpretTemplateInfo adds names to the field specifiers of a template
+// returned by Session.Templates or Session.Template, as InterpretTemplate
+// does for a TemplateRecord.
+func (i *Interpreter) InterpretTemplateInfo(info TemplateInfo) []InterpretedTemplateFieldSpecifier {
+	return i.InterpretTemplate(TemplateRecord{
+		TemplateID:      info.TemplateID,
+		FieldSpecifiers: info.FieldSpecifiers,
+	})
+}
+
 // AddDictionaryEntry adds a DictionaryEntry (containing a vendor field) to
 // the dictionary used by Interpret.
 func (i *Interpreter) AddDictionaryEntry(e DictionaryEntry) {
@@ -218,17 +286,22 @@ func interpretBytes(bs *[]byte, t FieldType) interface{} {
 	case Uint64:
 		return uint64(number(*bs))
 	case Int8:
-		return int8(number(*bs))
+		return int8(signedNumber(*bs))
 	case Int16:
-		return int16(number(*bs))
+		return int16(signedNumber(*bs))
 	case Int32:
-		return int32(number(*bs))
+		return int32(signedNumber(*bs))
 	case Int64:
-		return int64(number(*bs))
+		return signedNumber(*bs)
 	case Float32:
 		return math.Float32frombits(binary.BigEndian.Uint32(*bs))
 	case Float64:
-		return math.Float64frombits(binary.BigEndian.Uint64(*bs))
+		switch len(*bs) {
+		case 4:
+			return float64(math.Float32frombits(binary.BigEndian.Uint32(*bs)))
+		case 8:
+			return math.Float64frombits(binary.BigEndian.Uint64(*bs))
+		}
 	case Boolean:
 		return (*bs)[0] == 1
 	case Unknown, MacAddress, OctetArray:
@@ -240,16 +313,45 @@ func interpretBytes(bs *[]byte, t FieldType) interface{} {
 	case DateTimeMilliseconds:
 		unixTimeMs := int64(binary.BigEndian.Uint64(*bs))
 		return time.Unix(0, 0).Add(time.Duration(unixTimeMs) * time.Millisecond)
-	case DateTimeMicroseconds:
-		unixTimeUs := int64(binary.BigEndian.Uint64(*bs))
-		return time.Unix(0, 0).Add(time.Duration(unixTimeUs) * time.Microsecond)
-	case DateTimeNanoseconds:
-		unixTimeNs := int64(binary.BigEndian.Uint64(*bs))
-		return time.Unix(0, 0).Add(time.Duration(unixTimeNs))
+	case DateTimeMicroseconds, DateTimeNanoseconds:
+		return ntpTime(*bs, t)
 	}
 	return *bs
 }
 
+// Seconds from the NTP epoch, 1900-01-01, to the Unix epoch.
+const ntpEpochOffset = 2208988800
+
+// ntpTime interprets a dateTimeMicroseconds or dateTimeNanoseconds field,
+// which are NTP timestamps: 32 bits of seconds since 1900 and 32 bits of
+// binary fraction of a second.
+func ntpTime(bs []byte, t FieldType) time.Time {
+	secs := int64(binary.BigEndian.Uint32(bs))
+	frac := uint64(binary.BigEndian.Uint32(bs[4:]))
+	if t == DateTimeMicroseconds {
+		// RFC 7011 6.1.9: the low 11 bits are below microsecond precision
+		frac &^= 0x7ff
+	}
+	if secs < 1<<31 {
+		// Timestamps with the high bit clear are in the NTP era starting
+		// in 2036, as recommended by RFC 4330.
+		secs += 1 << 32
+	}
+	return time.Unix(secs-ntpEpochOffset, int64(frac*1e9>>32))
+}
+
+// legacyTime interprets a dateTimeMicroseconds or dateTimeNanoseconds field
+// as a count since the Unix epoch, see WithLegacyTimestamps.
+func legacyTime(bs []byte, t FieldType) time.Time {
+	unixTime := int64(binary.BigEndian.Uint64(bs))
+	if t == DateTimeMicroseconds {
+		return time.Unix(0, 0).Add(time.Duration(unixTime) * time.Microsecond)
+	}
+	return time.Unix(0, 0).Add(time.Duration(unixTime))
+}
+
+// number returns the value of the big endian unsigned integer in bs, which may
+// be reduced-size encoded in any number of bytes up to eight.
 func number(bs []byte) uint64 {
 	switch len(bs) {
 	case 1:
@@ -259,8 +361,24 @@ func number(bs []byte) uint64 {
 	case 4:
 		return uint64(binary.BigEndian.Uint32(bs))
 	case 8:
-		return uint64(binary.BigEndian.Uint64(bs))
+		return binary.BigEndian.Uint64(bs)
+	case 3, 5, 6, 7:
+		var n uint64
+		for _, b := range bs {
+			n = n<<8 | uint64(b)
+		}
+		return n
 	default:
 		return 0
 	}
 }
+
+// signedNumber is like number for two's complement signed integers, sign
+// extending reduced-size encoded values.
+func signedNumber(bs []byte) int64 {
+	if len(bs) == 0 || len(bs) > 8 {
+		return 0
+	}
+	shift := uint(64 - 8*len(bs))
+	return int64(number(bs)<<shift) >> shift
+}
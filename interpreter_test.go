@@ -3,9 +3,12 @@ package ipfix
 import (
 	"bytes"
 	"encoding/hex"
+	"errors"
+	"math"
 	"net"
 	"reflect"
 	"testing"
+	"time"
 )
 
 func TestInterpretUint(t *testing.T) {
@@ -60,6 +63,150 @@ func TestInterpretInt(t *testing.T) {
 	}
 }
 
+func TestInterpretReducedSize(t *testing.T) {
+	// Every reduced-size encoding of every integer type, with and without
+	// the high bit set.
+	cases := []struct {
+		t      FieldType
+		size   int
+		signed bool
+		conv   func(uint64) interface{}
+	}{
+		{Uint8, 1, false, func(n uint64) interface{} { return uint8(n) }},
+		{Uint16, 2, false, func(n uint64) interface{} { return uint16(n) }},
+		{Uint32, 4, false, func(n uint64) interface{} { return uint32(n) }},
+		{Uint64, 8, false, func(n uint64) interface{} { return n }},
+		{Int8, 1, true, func(n uint64) interface{} { return int8(n) }},
+		{Int16, 2, true, func(n uint64) interface{} { return int16(n) }},
+		{Int32, 4, true, func(n uint64) interface{} { return int32(n) }},
+		{Int64, 8, true, func(n uint64) interface{} { return int64(n) }},
+	}
+
+	for _, c := range cases {
+		for length := 1; length <= c.size; length++ {
+			for _, first := range []byte{0x71, 0xf1} {
+				bs := []byte{first}
+				for len(bs) < length {
+					bs = append(bs, byte(len(bs)+1))
+				}
+
+				var n uint64
+				for _, b := range bs {
+					n = n*256 + uint64(b)
+				}
+				if c.signed && first&0x80 != 0 && length < 8 {
+					n -= 1 << uint(8*length)
+				}
+
+				v := interpretBytes(&bs, c.t)
+				if exp := c.conv(n); v != exp {
+					t.Errorf("%v in %d bytes %x: %v != %v", c.t, length, bs, v, exp)
+				}
+			}
+		}
+	}
+
+	bs := []byte{0xff, 0xff}
+	if v := interpretBytes(&bs, Int32); v != int32(-1) {
+		t.Errorf("%v != %v", v, -1)
+	}
+
+	bs = []byte{0xff, 0xfe, 0x1d, 0xc0}
+	if v := interpretBytes(&bs, Int64); v != int64(-123456) {
+		t.Errorf("%v != %v", v, -123456)
+	}
+
+	bs = []byte{0x00, 0x80}
+	if v := interpretBytes(&bs, Int64); v != int64(128) {
+		t.Errorf("%v != %v", v, 128)
+	}
+}
+
+func TestInterpretFloat(t *testing.T) {
+	bs := []byte{0x40, 0x49, 0x0f, 0xdb}
+	if v := interpretBytes(&bs, Float32); v != float32(math.Pi) {
+		t.Errorf("%v != %v", v, float32(math.Pi))
+	}
+
+	bs = []byte{0x40, 0x09, 0x21, 0xfb, 0x54, 0x44, 0x2d, 0x18}
+	if v := interpretBytes(&bs, Float64); v != math.Pi {
+		t.Errorf("%v != %v", v, math.Pi)
+	}
+
+	// Reduced-size encoded as float32
+	bs = []byte{0x40, 0x49, 0x0f, 0xdb}
+	if v := interpretBytes(&bs, Float64); v != float64(float32(math.Pi)) {
+		t.Errorf("%v != %v", v, float64(float32(math.Pi)))
+	}
+
+	bs = []byte{0xc0, 0x20, 0x00, 0x00}
+	if v := interpretBytes(&bs, Float64); v != -2.5 {
+		t.Errorf("%v != %v", v, -2.5)
+	}
+
+	// Not a valid encoding, returned uninterpreted
+	bs = []byte{0x40, 0x09, 0x21, 0xfb, 0x54}
+	if v := interpretBytes(&bs, Float64); !reflect.DeepEqual(v, bs) {
+		t.Errorf("%v != %v", v, bs)
+	}
+
+	bs = []byte{0x40, 0x09}
+	if v := interpretBytes(&bs, Float64); !reflect.DeepEqual(v, bs) {
+		t.Errorf("%v != %v", v, bs)
+	}
+}
+
+func TestInterpretNTPTime(t *testing.T) {
+	cases := []struct {
+		bs  []byte
+		t   FieldType
+		exp time.Time
+	}{
+		// 2026-10-18 12:34:56.5
+		{[]byte{0xee, 0x7f, 0x3b, 0x70, 0x80, 0, 0, 0}, DateTimeMicroseconds, time.Date(2026, 10, 18, 12, 34, 56, 5e8, time.UTC)},
+		{[]byte{0xee, 0x7f, 0x3b, 0x70, 0x80, 0, 0, 0}, DateTimeNanoseconds, time.Date(2026, 10, 18, 12, 34, 56, 5e8, time.UTC)},
+		// Fractions below microsecond precision are ignored
+		{[]byte{0xee, 0x7f, 0x3b, 0x70, 0, 0, 0x07, 0xff}, DateTimeMicroseconds, time.Date(2026, 10, 18, 12, 34, 56, 0, time.UTC)},
+		{[]byte{0xee, 0x7f, 0x3b, 0x70, 0, 0, 0x07, 0xff}, DateTimeNanoseconds, time.Date(2026, 10, 18, 12, 34, 56, 476, time.UTC)},
+		// The Unix epoch
+		{[]byte{0x83, 0xaa, 0x7e, 0x80, 0, 0, 0, 0}, DateTimeNanoseconds, time.Unix(0, 0)},
+		// The next NTP era
+		{[]byte{0, 0, 0, 1, 0, 0, 0, 0}, DateTimeNanoseconds, time.Date(2036, 2, 7, 6, 28, 17, 0, time.UTC)},
+	}
+
+	i := NewInterpreter(NewSession())
+	for _, c := range cases {
+		bs := c.bs
+		v := i.interpretValue(&bs, c.t, listContext{})
+		if tm, ok := v.(time.Time); !ok || !tm.Equal(c.exp) {
+			t.Errorf("%x: %v != %v", c.bs, v, c.exp)
+		}
+	}
+
+	// A truncated timestamp is returned uninterpreted
+	bs := []byte{0xee, 0x7f, 0x3b, 0x70}
+	if v := i.interpretValue(&bs, DateTimeNanoseconds, listContext{}); !reflect.DeepEqual(v, bs) {
+		t.Errorf("%v != %v", v, bs)
+	}
+}
+
+func TestInterpretLegacyTime(t *testing.T) {
+	i := NewInterpreter(NewSession(), WithLegacyTimestamps(true))
+
+	// 1792326896500000 microseconds since the Unix epoch
+	bs := []byte{0x00, 0x06, 0x5e, 0x1c, 0x9f, 0xfc, 0xbd, 0x20}
+	exp := time.Date(2026, 10, 18, 12, 34, 56, 5e8, time.UTC)
+	if v, ok := i.interpretValue(&bs, DateTimeMicroseconds, listContext{}).(time.Time); !ok || !v.Equal(exp) {
+		t.Errorf("%v != %v", v, exp)
+	}
+
+	// 1792326896500000000 nanoseconds since the Unix epoch
+	bs = []byte{0x18, 0xdf, 0x9f, 0xd0, 0xf3, 0x42, 0xc5, 0x00}
+	if v, ok := i.interpretValue(&bs, DateTimeNanoseconds, listContext{}).(time.Time); !ok || !v.Equal(exp) {
+		t.Errorf("%v != %v", v, exp)
+	}
+}
+
 func TestInterpretBool(t *testing.T) {
 	bs := []byte{2}
 	v := interpretBytes(&bs, Boolean)
@@ -150,3 +297,261 @@ func TestIssue12(t *testing.T) {
 		t.Error("Didn't find expected field")
 	}
 }
+
+func TestInterpretOptions(t *testing.T) {
+	p0, _ := hex.DecodeString("000a003800000000000000000000000100030018010000030001009500040022000400230001000001000010000000010000006401000000")
+	p := NewSession()
+
+	msg, err := p.ParseBuffer(p0)
+	if err != nil {
+		t.Fatal("ParseBuffer failed", err)
+	}
+
+	i := NewInterpreter(p)
+	scope, fields := i.InterpretOptions(msg.OptionsDataRecords[0])
+
+	expectedScope := []InterpretedField{
+		{Name: "observationDomainId", FieldID: 149, Value: uint32(1)},
+	}
+	expectedFields := []InterpretedField{
+		{Name: "samplingInterval", FieldID: 34, Value: uint32(100)},
+		{Name: "samplingAlgorithm", FieldID: 35, Value: uint8(1)},
+	}
+
+	if !reflect.DeepEqual(scope, expectedScope) {
+		t.Error(scope, "!=\n", expectedScope)
+	}
+	if !reflect.DeepEqual(fields, expectedFields) {
+		t.Error(fields, "!=\n", expectedFields)
+	}
+}
+
+func TestInterpretBasicList(t *testing.T) {
+	// Template 256 with two basicLists; one of sourceTransportPort and one
+	// of variable length interfaceName.
+	p0, _ := hex.DecodeString("000a003b00000000000000000000000100020010010000020123ffff0123ffff0100001b090300070002005001bb0c040052ffff03657468026c6f")
+	p := NewSession()
+
+	msg, err := p.ParseBuffer(p0)
+	if err != nil {
+		t.Fatal("ParseBuffer failed", err)
+	}
+
+	i := NewInterpreter(p)
+	fields := i.Interpret(msg.DataRecords[0])
+
+	expected := []InterpretedField{
+		{Name: "basicList", FieldID: 291, Value: BasicListValue{
+			Semantic: AllOf,
+			FieldID:  7,
+			Name:     "sourceTransportPort",
+			Elements: []interface{}{uint16(80), uint16(443)},
+		}},
+		{Name: "basicList", FieldID: 291, Value: BasicListValue{
+			Semantic: Ordered,
+			FieldID:  82,
+			Name:     "interfaceName",
+			Elements: []interface{}{"eth", "lo"},
+		}},
+	}
+	if !reflect.DeepEqual(fields, expected) {
+		t.Error(fields, "!=\n", expected)
+	}
+}
+
+func TestInterpretBasicListUnknownElement(t *testing.T) {
+	// A basicList of the unknown enterprise field 12345/42
+	p0, _ := hex.DecodeString("000a002c0000000000000000000000010002000c010100010123ffff010100100bff802a0001000030390102")
+	p := NewSession()
+
+	msg, err := p.ParseBuffer(p0)
+	if err != nil {
+		t.Fatal("ParseBuffer failed", err)
+	}
+
+	i := NewInterpreter(p)
+	fields := i.Interpret(msg.DataRecords[0])
+
+	expected := BasicListValue{
+		Semantic:     UndefinedSemantic,
+		FieldID:      42,
+		EnterpriseID: 12345,
+		Elements:     []interface{}{[]byte{1}, []byte{2}},
+	}
+	if !reflect.DeepEqual(fields[0].Value, expected) {
+		t.Error(fields[0].Value, "!=\n", expected)
+	}
+
+	// A truncated list is returned uninterpreted
+	bs := []byte{3, 0, 7, 0, 2, 0}
+	if v := i.interpretValue(&bs, BasicList, listContext{}); !reflect.DeepEqual(v, bs) {
+		t.Error("Truncated list interpreted as", v)
+	}
+}
+
+func TestInterpretSubTemplateList(t *testing.T) {
+	// Template 257 with sourceTransportPort and protocolIdentifier, and
+	// template 256 with a subTemplateList of two 257 records.
+	p0, _ := hex.DecodeString("000a003600000000000000000000000100020018010100020007000200040001010000010124ffff0100000e09030101005006003511")
+	p := NewSession()
+
+	msg, err := p.ParseBuffer(p0)
+	if err != nil {
+		t.Fatal("ParseBuffer failed", err)
+	}
+
+	i := NewInterpreter(p)
+	fields := i.Interpret(msg.DataRecords[0])
+
+	expected := SubTemplateListValue{
+		Semantic:   AllOf,
+		TemplateID: 257,
+		Records: []DataRecord{
+			{DomainID: 1, TemplateID: 257, Fields: [][]byte{{0, 80}, {6}}},
+			{DomainID: 1, TemplateID: 257, Fields: [][]byte{{0, 53}, {17}}},
+		},
+		Fields: [][]InterpretedField{
+			{{Name: "sourceTransportPort", FieldID: 7, Value: uint16(80)}, {Name: "protocolIdentifier", FieldID: 4, Value: uint8(6)}},
+			{{Name: "sourceTransportPort", FieldID: 7, Value: uint16(53)}, {Name: "protocolIdentifier", FieldID: 4, Value: uint8(17)}},
+		},
+	}
+	if !reflect.DeepEqual(fields[0].Value, expected) {
+		t.Error(fields[0].Value, "!=\n", expected)
+	}
+
+	// The records can be interpreted as any other
+	rec := fields[0].Value.(SubTemplateListValue).Records[1]
+	if v := i.Interpret(rec); !reflect.DeepEqual(v, expected.Fields[1]) {
+		t.Error(v, "!=\n", expected.Fields[1])
+	}
+}
+
+func TestInterpretSubTemplateListDepth(t *testing.T) {
+	// Template 258 with a subTemplateList, which may contain records of
+	// template 258.
+	p0, _ := hex.DecodeString("000a001c0000000000000000000000010002000c010200010124ffff")
+	p := NewSession()
+
+	if _, err := p.ParseBuffer(p0); err != nil {
+		t.Fatal("ParseBuffer failed", err)
+	}
+
+	nest := func(depth int) []byte {
+		bs := []byte{3, 1, 2} // innermost list is empty
+		for d := 1; d < depth; d++ {
+			bs = append([]byte{3, 1, 2, byte(len(bs))}, bs...)
+		}
+		return bs
+	}
+
+	i := NewInterpreter(p)
+	ctx := listContext{domainID: 1}
+
+	bs := nest(maxListDepth)
+	v := i.interpretValue(&bs, SubTemplateList, ctx)
+	for d := 1; d < maxListDepth; d++ {
+		l, ok := v.(SubTemplateListValue)
+		if !ok || len(l.Fields) != 1 {
+			t.Fatal("Incorrect list at depth", d, v)
+		}
+		v = l.Fields[0][0].Value
+	}
+	if l, ok := v.(SubTemplateListValue); !ok || len(l.Records) != 0 {
+		t.Error("Incorrect innermost list", v)
+	}
+
+	// The innermost list is too deep to interpret
+	bs = nest(maxListDepth + 1)
+	v = i.interpretValue(&bs, SubTemplateList, ctx)
+	for d := 1; d <= maxListDepth; d++ {
+		l, ok := v.(SubTemplateListValue)
+		if !ok || len(l.Fields) != 1 {
+			t.Fatal("Incorrect list at depth", d, v)
+		}
+		v = l.Fields[0][0].Value
+	}
+	if !reflect.DeepEqual(v, []byte{3, 1, 2}) {
+		t.Error("Too deep list interpreted as", v)
+	}
+
+	// Unknown template
+	bs = []byte{3, 1, 3, 0, 1}
+	v = i.interpretValue(&bs, SubTemplateList, ctx)
+	if l, ok := v.(SubTemplateListValue); !ok || !errors.Is(l.Err, ErrUnknownTemplate) || l.TemplateID != 259 || l.Records != nil {
+		t.Error("List of unknown template interpreted as", v)
+	}
+}
+
+func TestInterpretSubTemplateMultiList(t *testing.T) {
+	// Templates 257 with sourceTransportPort and protocolIdentifier and 258
+	// with sourceIPv4Address, and template 256 with a subTemplateMultiList
+	// of two 257 records, one 258 record and a group of the unknown template
+	// 300.
+	p0, _ := hex.DecodeString("000a004e000000000000000000000001000200200101000200070002000400010102000100080004010000010125ffff0100001e19030101000a005006003511010200080a000001012c00060102")
+	p := NewSession()
+
+	msg, err := p.ParseBuffer(p0)
+	if err != nil {
+		t.Fatal("ParseBuffer failed", err)
+	}
+
+	i := NewInterpreter(p)
+	fields := i.Interpret(msg.DataRecords[0])
+
+	l, ok := fields[0].Value.(SubTemplateMultiListValue)
+	if !ok {
+		t.Fatal("Incorrect value", fields[0].Value)
+	}
+	if l.Semantic != AllOf {
+		t.Error("Incorrect semantic", l.Semantic)
+	}
+	if len(l.Lists) != 3 {
+		t.Fatal("Incorrect number of lists", len(l.Lists))
+	}
+
+	ip := net.IP{10, 0, 0, 1}
+	expected := []SubTemplateListValue{
+		{
+			Semantic:   AllOf,
+			TemplateID: 257,
+			Records: []DataRecord{
+				{DomainID: 1, TemplateID: 257, Fields: [][]byte{{0, 80}, {6}}},
+				{DomainID: 1, TemplateID: 257, Fields: [][]byte{{0, 53}, {17}}},
+			},
+			Fields: [][]InterpretedField{
+				{{Name: "sourceTransportPort", FieldID: 7, Value: uint16(80)}, {Name: "protocolIdentifier", FieldID: 4, Value: uint8(6)}},
+				{{Name: "sourceTransportPort", FieldID: 7, Value: uint16(53)}, {Name: "protocolIdentifier", FieldID: 4, Value: uint8(17)}},
+			},
+		},
+		{
+			Semantic:   AllOf,
+			TemplateID: 258,
+			Records: []DataRecord{
+				{DomainID: 1, TemplateID: 258, Fields: [][]byte{{10, 0, 0, 1}}},
+			},
+			Fields: [][]InterpretedField{
+				{{Name: "sourceIPv4Address", FieldID: 8, Value: &ip}},
+			},
+		},
+	}
+	if !reflect.DeepEqual(l.Lists[:2], expected) {
+		t.Error(l.Lists[:2], "!=\n", expected)
+	}
+
+	if !errors.Is(l.Lists[2].Err, ErrUnknownTemplate) {
+		t.Error("Incorrect error for unknown template", l.Lists[2].Err)
+	}
+	if l.Lists[2].Err.Error() != "unknown template 1/300" {
+		t.Error("Incorrect error message", l.Lists[2].Err)
+	}
+	if l.Lists[2].TemplateID != 300 || l.Lists[2].Records != nil {
+		t.Error("Incorrect list of unknown template", l.Lists[2])
+	}
+
+	// A group exceeding the list makes it corrupt
+	bs := []byte{3, 1, 1, 0, 9, 0, 80, 6}
+	ctx := listContext{domainID: 1}
+	if v := i.interpretValue(&bs, SubTemplateMultiList, ctx); !reflect.DeepEqual(v, bs) {
+		t.Error("Corrupt list interpreted as", v)
+	}
+}
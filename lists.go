@@ -0,0 +1,253 @@
+package ipfix
+
+import (
+	"errors"
+	"fmt"
+)
+
+// ListSemantic describes the relationship between the elements of a
+// structured data list, as defined by RFC 6313.
+type ListSemantic uint8
+
+// The list semantics defined by RFC 6313.
+const (
+	NoneOf            ListSemantic = 0
+	ExactlyOneOf      ListSemantic = 1
+	OneOrMoreOf       ListSemantic = 2
+	AllOf             ListSemantic = 3
+	Ordered           ListSemantic = 4
+	UndefinedSemantic ListSemantic = 255
+)
+
+func (s ListSemantic) String() string {
+	switch s {
+	case NoneOf:
+		return "noneOf"
+	case ExactlyOneOf:
+		return "exactlyOneOf"
+	case OneOrMoreOf:
+		return "oneOrMoreOf"
+	case AllOf:
+		return "allOf"
+	case Ordered:
+		return "ordered"
+	case UndefinedSemantic:
+		return "undefined"
+	default:
+		return "invalid"
+	}
+}
+
+// A BasicListValue is the interpreted value of a basicList field: a list of values
+// of a single Information Element. The Elements are interpreted according to
+// the element's dictionary entry, whose name is given in Name. If the
+// element is not in the dictionary, Name is the empty string and the Elements
+// are the raw []byte values.
+type BasicListValue struct {
+	Semantic     ListSemantic
+	FieldID      uint16
+	EnterpriseID uint32
+	Name         string
+	Elements     []interface{}
+}
+
+// ErrUnknownTemplate is the Err of a SubTemplateListValue whose template is
+// not known to the Session.
+var ErrUnknownTemplate = errors.New("unknown template")
+
+// A SubTemplateListValue is the interpreted value of a subTemplateList field:
+// a list of records described by a single template. TemplateID is the
+// template ID used by the exporter. The Records carry the same template ID as
+// records in a Message would, and can be interpreted like them; Fields holds
+// the interpreted fields of each record. If the template is unknown, Err
+// wraps ErrUnknownTemplate and there are no Records.
+type SubTemplateListValue struct {
+	Semantic   ListSemantic
+	TemplateID uint16
+	Records    []DataRecord
+	Fields     [][]InterpretedField
+	Err        error
+}
+
+// A SubTemplateMultiListValue is the interpreted value of a
+// subTemplateMultiList field: groups of records, each described by its own
+// template. The Semantic of each of the Lists is that of the field.
+type SubTemplateMultiListValue struct {
+	Semantic ListSemantic
+	Lists    []SubTemplateListValue
+}
+
+// Lists nested deeper than this are returned uninterpreted.
+const maxListDepth = 8
+
+// listContext is what interpreting structured data needs to know about the
+// record containing it.
+type listContext struct {
+	domainID uint32 // where referenced templates are looked up
+	depth    int    // the number of lists containing the value
+}
+
+// interpretValue interprets the bytes as the given type, like interpretBytes,
+// with support for the structured data types whose elements are looked up in
+// the dictionary or the Session, and for the options of the Interpreter.
+func (i *Interpreter) interpretValue(bs *[]byte, t FieldType, ctx listContext) interface{} {
+	var v interface{}
+	var ok bool
+
+	switch t {
+	case BasicList:
+		v, ok = i.interpretBasicList(*bs, ctx)
+	case SubTemplateList:
+		v, ok = i.interpretSubTemplateList(*bs, ctx)
+	case SubTemplateMultiList:
+		v, ok = i.interpretSubTemplateMultiList(*bs, ctx)
+	case DateTimeMicroseconds, DateTimeNanoseconds:
+		if i.legacyTimestamps && len(*bs) >= t.minLength() {
+			return legacyTime(*bs, t)
+		}
+		return interpretBytes(bs, t)
+	default:
+		return interpretBytes(bs, t)
+	}
+
+	if !ok {
+		// Corrupt or too deeply nested list - return it uninterpreted.
+		return *bs
+	}
+	return v
+}
+
+func (i *Interpreter) interpretBasicList(bs []byte, ctx listContext) (BasicListValue, bool) {
+	ctx.depth++
+	if ctx.depth > maxListDepth {
+		return BasicListValue{}, false
+	}
+
+	sl := newSlice(bs)
+
+	var l BasicListValue
+	l.Semantic = ListSemantic(sl.Uint8())
+	l.FieldID = sl.Uint16()
+	elemLen := sl.Uint16()
+	if l.FieldID >= 0x8000 {
+		l.FieldID -= 0x8000
+		l.EnterpriseID = sl.Uint32()
+	}
+	if sl.Error() != nil || elemLen == 0 && sl.Len() > 0 {
+		return BasicListValue{}, false
+	}
+
+	entry, known := i.dictionary[dictionaryKey{l.EnterpriseID, l.FieldID}]
+	l.Name = entry.Name
+
+	for sl.Len() > 0 {
+		var elem []byte
+		if elemLen == 65535 {
+			elem, _ = i.session.readVariableLength(sl)
+		} else {
+			elem = sl.Cut(int(elemLen))
+		}
+		if sl.Error() != nil {
+			return BasicListValue{}, false
+		}
+
+		if known {
+			l.Elements = append(l.Elements, i.interpretValue(&elem, entry.Type, ctx))
+		} else {
+			l.Elements = append(l.Elements, elem)
+		}
+	}
+
+	return l, true
+}
+
+func (i *Interpreter) interpretSubTemplateList(bs []byte, ctx listContext) (SubTemplateListValue, bool) {
+	ctx.depth++
+	if ctx.depth > maxListDepth {
+		return SubTemplateListValue{}, false
+	}
+
+	sl := newSlice(bs)
+	semantic := ListSemantic(sl.Uint8())
+	tid := sl.Uint16()
+	if sl.Error() != nil {
+		return SubTemplateListValue{}, false
+	}
+
+	return i.interpretSubTemplateRecords(sl, semantic, tid, ctx)
+}
+
+func (i *Interpreter) interpretSubTemplateMultiList(bs []byte, ctx listContext) (SubTemplateMultiListValue, bool) {
+	ctx.depth++
+	if ctx.depth > maxListDepth {
+		return SubTemplateMultiListValue{}, false
+	}
+
+	sl := newSlice(bs)
+
+	var l SubTemplateMultiListValue
+	l.Semantic = ListSemantic(sl.Uint8())
+	if sl.Error() != nil {
+		return SubTemplateMultiListValue{}, false
+	}
+
+	for sl.Len() > 0 {
+		// Each group is the template ID and the length of the group,
+		// including this header, followed by the records.
+		tid := sl.Uint16()
+		length := sl.Uint16()
+		if sl.Error() != nil || length < 4 {
+			return SubTemplateMultiListValue{}, false
+		}
+		group := sl.Cut(int(length) - 4)
+		if sl.Error() != nil {
+			return SubTemplateMultiListValue{}, false
+		}
+
+		sub, ok := i.interpretSubTemplateRecords(newSlice(group), l.Semantic, tid, ctx)
+		if !ok {
+			return SubTemplateMultiListValue{}, false
+		}
+		l.Lists = append(l.Lists, sub)
+	}
+
+	return l, true
+}
+
+// interpretSubTemplateRecords reads the records of template tid remaining in
+// sl. A missing template is reported in the returned value, other problems
+// make the list corrupt.
+func (i *Interpreter) interpretSubTemplateRecords(sl *slice, semantic ListSemantic, tid uint16, ctx listContext) (SubTemplateListValue, bool) {
+	l := SubTemplateListValue{
+		Semantic:   semantic,
+		TemplateID: tid,
+	}
+
+	tpl := i.session.lookupTemplate(templateKey{ctx.domainID, tid})
+	if tpl == nil {
+		if debug {
+			dl.Printf("list of unknown template %d/%d", ctx.domainID, tid)
+		}
+		l.Err = fmt.Errorf("%w %d/%d", ErrUnknownTemplate, ctx.domainID, tid)
+		return l, true
+	}
+
+	if i.session.withIDAliasing {
+		tid = tpl.alias
+	}
+
+	for sl.Len() > 0 {
+		// The records are slices of the field value
+		rec, err := i.session.readDataRecord(sl, tpl.specifiers, true)
+		if err != nil {
+			return SubTemplateListValue{}, false
+		}
+		rec.DomainID = ctx.domainID
+		rec.TemplateID = tid
+
+		l.Records = append(l.Records, rec)
+		l.Fields = append(l.Fields, i.interpretFields(tpl.specifiers, rec.Fields, nil, ctx))
+	}
+
+	return l, true
+}
@@ -1,12 +1,14 @@
 package ipfix
 
 import (
-	"bytes"
 	"crypto/sha1"
-	"encoding/binary"
 	"errors"
+	"fmt"
 	"io"
+	"net"
 	"sync"
+	"sync/atomic"
+	"time"
 )
 
 // The version field in IPFIX messages should always have the value 10. If it
@@ -24,17 +26,90 @@ var ErrRead = errors.New("short read - malformed packet?")
 // error are encountered.
 var ErrProtocol = errors.New("protocol error")
 
+// ErrTemplateIDsExhausted is returned when ID aliasing is enabled and a new
+// template layout arrives while all virtual template IDs are in use by
+// current templates. The template is not registered.
+var ErrTemplateIDsExhausted = errors.New("out of virtual template IDs")
+
+// A ParseError describes where in a message parsing failed. Err is one of the
+// errors above or io.ErrUnexpectedEOF, and errors.Is can be used to compare
+// against those.
+type ParseError struct {
+	Offset     int    // Byte offset from the start of the message
+	SetID      uint16 // The set containing the problem
+	TemplateID uint16 // The template ID of the record, when known
+	Record     int    // Index of the record within the set, or -1 for the set itself
+	Reason     string
+	Err        error
+}
+
+func (e *ParseError) Error() string {
+	if e.Record < 0 {
+		return fmt.Sprintf("set %d at offset %d: %s: %v", e.SetID, e.Offset, e.Reason, e.Err)
+	}
+	return fmt.Sprintf("set %d record %d (template %d) at offset %d: %s: %v", e.SetID, e.Record, e.TemplateID, e.Offset, e.Reason, e.Err)
+}
+
+func (e *ParseError) Unwrap() error {
+	return e.Err
+}
+
+// setError returns err as a ParseError for the set at the given offset.
+// ParseErrors for records within the set have an offset relative to the
+// start of the set data, which is adjusted.
+func setError(err error, offset int, setID uint16, reason string) error {
+	if pe, ok := err.(*ParseError); ok {
+		pe.Offset += offset + setHeaderLength
+		pe.SetID = setID
+		return pe
+	}
+	return &ParseError{
+		Offset: offset,
+		SetID:  setID,
+		Record: -1,
+		Reason: reason,
+		Err:    err,
+	}
+}
+
+// recordError returns err as a ParseError for the record starting at the
+// given offset into the set data.
+func recordError(err error, offset int, templateID uint16, record int, reason string) error {
+	return &ParseError{
+		Offset:     offset,
+		TemplateID: templateID,
+		Record:     record,
+		Reason:     reason,
+		Err:        err,
+	}
+}
+
 // A Message is the top level construct representing an IPFIX message. A well
 // formed message contains one or more sets of data or template information.
+// Sequence is the result of checking the sequence number in the header
+// against the previous messages from the same Observation Domain. Errors
+// lists the malformed sets skipped with WithLenientParsing, and
+// TemplateViolations the problems found by WithTemplateValidation.
 type Message struct {
-	Header          MessageHeader
-	DataRecords     []DataRecord
-	TemplateRecords []TemplateRecord
+	Header                 MessageHeader
+	Sequence               SequenceCheck
+	DataRecords            []DataRecord
+	TemplateRecords        []TemplateRecord
+	OptionsDataRecords     []OptionsDataRecord
+	OptionsTemplateRecords []OptionsTemplateRecord
+	Withdrawals            []TemplateWithdrawal
+	Errors                 []error
+	TemplateViolations     []TemplateViolation
+
+	noCopy           bool // record fields alias the parsed buffer
+	unknownSets      int  // data sets that could not be decoded
+	recoveredRecords int  // records decoded from data sets buffered earlier
 }
 
 // The MessageHeader provides metadata for the entire Message. The sequence
 // number and domain ID can be used to gain knowledge of messages lost on an
-// unreliable transport such as UDP.
+// unreliable transport such as UDP; the Session does so and reports the
+// result in Message.Sequence and LossStats.
 type MessageHeader struct {
 	Version        uint16 // Always 0x0a
 	Length         uint16
@@ -71,20 +146,68 @@ func (h *templateHeader) unmarshal(s *slice) {
 	h.FieldCount = s.Uint16()
 }
 
+type optionsTemplateHeader struct {
+	TemplateID      uint16
+	FieldCount      uint16
+	ScopeFieldCount uint16
+}
+
+func (h *optionsTemplateHeader) unmarshal(s *slice) {
+	h.TemplateID = s.Uint16()
+	h.FieldCount = s.Uint16()
+	if h.FieldCount > 0 {
+		// A withdrawal has no scope field count
+		h.ScopeFieldCount = s.Uint16()
+	}
+}
+
 // The DataRecord represents a single exported flow. The Fields each describe
 // different aspects of the flow (source and destination address, counters,
 // service, etc.).
 type DataRecord struct {
+	DomainID   uint32
 	TemplateID uint16
 	Fields     [][]byte
 }
 
+// The OptionsDataRecord represents a single record described by an options
+// template, such as a row in a sampler or interface table. The ScopeFields
+// identify what the record applies to, the Fields carry the option values.
+type OptionsDataRecord struct {
+	DomainID    uint32
+	TemplateID  uint16
+	ScopeFields [][]byte
+	Fields      [][]byte
+}
+
 // The TemplateRecord describes a data template, as used by DataRecords.
 type TemplateRecord struct {
 	TemplateID      uint16
 	FieldSpecifiers []TemplateFieldSpecifier
 }
 
+// The OptionsTemplateRecord describes an options template, as used by
+// DataRecords carrying information about the exporter itself (sampler
+// configuration, interface tables, exporting process statistics, etc.). The
+// ScopeFieldSpecifiers describe the fields that the options apply to and
+// precede the FieldSpecifiers in the corresponding DataRecords.
+type OptionsTemplateRecord struct {
+	TemplateID           uint16
+	ScopeFieldCount      uint16
+	ScopeFieldSpecifiers []TemplateFieldSpecifier
+	FieldSpecifiers      []TemplateFieldSpecifier
+}
+
+// A TemplateWithdrawal reports that the exporter withdrew a template or
+// options template, or all of them, from the Observation Domain of the
+// message. Data sets using a withdrawn template are treated as having an
+// unknown template.
+type TemplateWithdrawal struct {
+	TemplateID uint16 // The withdrawn template ID; 2 or 3 when All is set
+	Options    bool   // Withdrawn by an Options Template Set
+	All        bool   // All templates, or all options templates, were withdrawn
+}
+
 // The TemplateFieldSpecifier describes the ID and size of the corresponding
 // Fields in a DataRecord.
 type TemplateFieldSpecifier struct {
@@ -103,18 +226,53 @@ func WithIDAliasing(v bool) Option {
 	}
 }
 
+// WithTemplateTimeout sets the time after which a template that has not been
+// refreshed by the exporter expires, as required for UDP transport. Data sets
+// using an expired template are treated as having an unknown template. The
+// default is zero, meaning templates never expire.
+func WithTemplateTimeout(d time.Duration) Option {
+	return func(s *Session) {
+		s.templateTimeout = d
+	}
+}
+
+// WithLenientParsing enables or disables lenient parsing. In lenient mode a
+// malformed set is skipped, using the set length, and reported in
+// Message.Errors; the records from the other sets of the message are returned
+// as usual. If the set length itself can't be trusted, the rest of the
+// message is skipped. The default is disabled, so that the first problem
+// fails the whole message. RecordCursors always parse strictly.
+func WithLenientParsing(v bool) Option {
+	return func(s *Session) {
+		s.lenient = v
+	}
+}
+
 // The Session is the context for IPFIX messages.
 type Session struct {
-	buffers *sync.Pool
+	nextExpiry int64        // unix nanoseconds, accessed atomically; keep first for alignment
+	stats      sessionStats // accessed atomically; keep next for alignment
 
-	withIDAliasing bool
-
-	mut        sync.RWMutex
-	minRecord  map[uint16]uint16
-	signatures map[[sha1.Size]byte]uint16
-	specifiers map[uint16][]TemplateFieldSpecifier
-	aliases    map[uint16]uint16
-	nextID     uint16
+	buffers *sync.Pool
+	now     func() time.Time
+
+	withIDAliasing  bool
+	lenient         bool
+	validation      TemplateValidation
+	templateTimeout time.Duration
+	hooks           []func(TemplateEvent)
+	exporter        net.Addr
+
+	sequences sequenceTracker
+	pending   pendingCache
+
+	mut         sync.RWMutex
+	templates   map[templateKey]*template
+	signatures  map[[sha1.Size]byte]uint16
+	virtual     map[uint16]*template
+	aliasRefs   map[uint16]int // number of templates using each virtual template
+	freeAliases []uint16       // unreferenced virtual templates, least recently released first
+	nextID      uint16
 }
 
 // NewSession initializes a new Session based on the provided io.Reader.
@@ -125,6 +283,7 @@ func NewSession(opts ...Option) *Session {
 			return make([]byte, 65536)
 		},
 	}
+	s.now = time.Now
 
 	for _, opt := range opts {
 		opt(&s)
@@ -132,19 +291,20 @@ func NewSession(opts ...Option) *Session {
 
 	if s.withIDAliasing {
 		s.signatures = make(map[[sha1.Size]byte]uint16)
-		s.aliases = make(map[uint16]uint16)
+		s.virtual = make(map[uint16]*template)
+		s.aliasRefs = make(map[uint16]int)
 		s.nextID = 256
 	}
 
-	s.specifiers = make(map[uint16][]TemplateFieldSpecifier)
-	s.minRecord = make(map[uint16]uint16)
+	s.templates = make(map[templateKey]*template)
 
 	return &s
 }
 
 const (
-	msgHeaderLength = 2 + 2 + 4 + 4 + 4
-	setHeaderLength = 2 + 2
+	msgHeaderLength      = 2 + 2 + 4 + 4 + 4
+	setHeaderLength      = 2 + 2
+	templateHeaderLength = 2 + 2
 )
 
 // ParseReader extracts and returns one message from the IPFIX stream. As long
@@ -157,6 +317,9 @@ func (s *Session) ParseReader(r io.Reader) (Message, error) {
 	bs := s.buffers.Get().([]byte)
 	bs, hdr, err := Read(r, bs)
 	if err != nil {
+		if err != io.EOF {
+			s.stats.countError(err)
+		}
 		return Message{}, err
 	}
 
@@ -164,357 +327,461 @@ func (s *Session) ParseReader(r io.Reader) (Message, error) {
 	var msg Message
 	msg.Header = hdr
 
-	msg.TemplateRecords, msg.DataRecords, err = s.readBuffer(sl)
+	err = s.readBuffer(sl, &msg)
 	s.buffers.Put(bs)
-	return msg, err
+	if err != nil {
+		s.stats.countError(err)
+		return Message{Header: msg.Header}, err
+	}
+	return msg, nil
 }
 
 // ParseBuffer extracts one message from the given buffer and returns it. Err
-// is nil if the buffer could be parsed correctly. ParseBuffer is goroutine safe.
+// is nil if the buffer could be parsed correctly. The message header is
+// validated as by Read, and only the message length given in the header is
+// parsed; any bytes following the message are ignored. ParseBuffer is
+// goroutine safe.
 func (s *Session) ParseBuffer(bs []byte) (Message, error) {
-	var msg Message
-	var err error
+	msg, _, err := s.parseMessage(bs, false)
+	return msg, err
+}
 
-	sl := newSlice(bs)
-	msg.Header.unmarshal(sl)
-	msg.TemplateRecords, msg.DataRecords, err = s.readBuffer(sl)
+// ParseBufferNoCopy is like ParseBuffer, but avoids copying the fields of
+// each record to separate storage. Instead, the Fields of the returned
+// DataRecords and OptionsDataRecords are slices of bs. The caller must not
+// modify or reuse bs for as long as the records, or any values interpreted
+// from them, are in use. ParseBufferNoCopy is goroutine safe.
+func (s *Session) ParseBufferNoCopy(bs []byte) (Message, error) {
+	msg, _, err := s.parseMessage(bs, true)
 	return msg, err
 }
 
-func (s *Session) readBuffer(sl *slice) ([]TemplateRecord, []DataRecord, error) {
-	var ts, trecs []TemplateRecord
-	var ds, drecs []DataRecord
-	var err error
+// ParseBufferAll extracts all messages from the given buffer, which holds
+// one or more messages back to back, as some exporters send in a single UDP
+// datagram. Parsing stops at the first error, which is returned together
+// with the messages parsed before it. ParseBufferAll is goroutine safe.
+func (s *Session) ParseBufferAll(bs []byte) ([]Message, error) {
+	var msgs []Message
+	for len(bs) > 0 {
+		msg, rest, err := s.parseMessage(bs, false)
+		if err != nil {
+			return msgs, err
+		}
+		msgs = append(msgs, msg)
+		bs = rest
+	}
+	return msgs, nil
+}
 
-	for sl.Len() > 0 {
-		// Read a set header
-		var setHdr setHeader
-		setHdr.unmarshal(sl)
+// parseMessage parses the message at the start of bs, returning it and the
+// bytes following it.
+func (s *Session) parseMessage(bs []byte, noCopy bool) (Message, []byte, error) {
+	msg := Message{noCopy: noCopy}
 
-		if debug {
-			dl.Printf("setHdr: %+v", setHdr)
-		}
+	hdr, body, rest, err := splitMessage(bs)
+	msg.Header = hdr
+	if err != nil {
+		s.stats.countError(err)
+		return Message{Header: hdr}, nil, err
+	}
 
-		if setHdr.Length < setHeaderLength {
-			// Set cannot be shorter than its header
-			if debug {
-				dl.Println("setHdr too short")
-			}
-			return nil, nil, io.ErrUnexpectedEOF
-		}
+	if err := s.readBuffer(newSlice(body), &msg); err != nil {
+		s.stats.countError(err)
+		return Message{Header: msg.Header}, rest, err
+	}
+	return msg, rest, nil
+}
 
-		// Grab the bytes representing the set
-		setLen := int(setHdr.Length) - setHeaderLength
-		setSl := newSlice(sl.Cut(setLen))
-		if err := sl.Error(); err != nil {
-			if debug {
-				dl.Println("slice error")
+// splitMessage reads and validates the header of the message at the start of
+// bs, returning it along with the message body and the bytes following the
+// message.
+func splitMessage(bs []byte) (hdr MessageHeader, body, rest []byte, err error) {
+	sl := newSlice(bs)
+	hdr.unmarshal(sl)
+	switch {
+	case sl.Error() != nil:
+		return hdr, nil, nil, io.ErrUnexpectedEOF
+	case hdr.Version != 10:
+		return hdr, nil, nil, ErrVersion
+	case hdr.Length < msgHeaderLength || int(hdr.Length) > len(bs):
+		// Message can't be shorter than its header, or longer than the
+		// buffer
+		return hdr, nil, nil, io.ErrUnexpectedEOF
+	}
+	return hdr, bs[msgHeaderLength:hdr.Length], bs[hdr.Length:], nil
+}
+
+func (s *Session) readBuffer(sl *slice, msg *Message) error {
+	s.expire()
+	s.stats.countMessage(msg.Header)
+
+	size := sl.Len()
+	for sl.Len() > 0 {
+		offset := msgHeaderLength + size - sl.Len()
+
+		setHdr, set, err := cutSet(sl, offset)
+		if err != nil {
+			// The following sets can't be found
+			if !s.lenient {
+				return err
 			}
-			return nil, nil, err
+			msg.Errors = append(msg.Errors, err)
+			s.stats.countError(err)
+			msg.unknownSets++
+			break
 		}
 
 		// Parse them
-		ts, ds, err = s.readSet(setHdr, setSl)
-		if err != nil {
+		s.stats.countSet(setHdr.SetID)
+		drecs, orecs := len(msg.DataRecords), len(msg.OptionsDataRecords)
+		if err := s.readSet(setHdr, newSlice(set), msg); err != nil {
+			err = setError(err, offset, setHdr.SetID, "reserved set ID")
 			if debug {
 				dl.Println("readSet:", err)
 			}
-			return nil, nil, err
+			if !s.lenient {
+				return err
+			}
+
+			// Skip the set. The records decoded from it before the problem
+			// are dropped as well, so the count for the sequence number
+			// check is unknown.
+			msg.Errors = append(msg.Errors, err)
+			s.stats.countError(err)
+			if setHdr.SetID >= 256 {
+				msg.DataRecords = msg.DataRecords[:drecs]
+				msg.OptionsDataRecords = msg.OptionsDataRecords[:orecs]
+				msg.unknownSets++
+			}
 		}
+	}
+
+	records := len(msg.DataRecords) + len(msg.OptionsDataRecords) - msg.recoveredRecords
+	msg.Sequence = s.sequences.check(msg.Header, records, msg.unknownSets == 0)
+	s.stats.countRecords(msg)
 
-		trecs = append(trecs, ts...)
-		drecs = append(drecs, ds...)
+	return nil
+}
+
+// cutSet reads the set header at the start of sl and cuts the contents of the
+// set from it. The offset of the set in the message is used for errors.
+func cutSet(sl *slice, offset int) (setHeader, []byte, error) {
+	var setHdr setHeader
+	setHdr.unmarshal(sl)
+
+	if debug {
+		dl.Printf("setHdr: %+v", setHdr)
 	}
 
-	return trecs, drecs, nil
+	if setHdr.Length < setHeaderLength {
+		// Set cannot be shorter than its header
+		return setHdr, nil, setError(io.ErrUnexpectedEOF, offset, setHdr.SetID, "set shorter than its header")
+	}
+
+	set := sl.Cut(int(setHdr.Length) - setHeaderLength)
+	if err := sl.Error(); err != nil {
+		return setHdr, nil, setError(err, offset, setHdr.SetID, "set exceeds message")
+	}
+	return setHdr, set, nil
 }
 
-func (s *Session) readSet(setHdr setHeader, sl *slice) ([]TemplateRecord, []DataRecord, error) {
-	var trecs []TemplateRecord
-	var drecs []DataRecord
+func (s *Session) readSet(setHdr setHeader, sl *slice, msg *Message) error {
+	// Set ID
+	//
+	// Identifies the Set.  A value of 2 is reserved for Template Sets. A
+	// value of 3 is reserved for Options Template Sets.  Values from 4 to
+	// 255 are reserved for future use.  Values 256 and above are used for
+	// Data Sets.  The Set ID values of 0 and 1 are not used, for
+	// historical reasons [RFC3954].
+
+	switch {
+	case setHdr.SetID < 2:
+		// Unused, shouldn't happen
+		if debug {
+			dl.Println("bad SetID", setHdr.SetID)
+		}
+		return ErrProtocol
+
+	case setHdr.SetID == 2:
+		// Template Set
+		if debug {
+			dl.Println("parsing template set")
+		}
+		return s.readTemplateSet(sl, msg)
 
-	minLen := int(s.getMinRecLen(setHdr.SetID))
+	case setHdr.SetID == 3:
+		// Options Template Set
+		if debug {
+			dl.Println("parsing options template set")
+		}
+		return s.readOptionsTemplateSet(sl, msg)
 
-	for sl.Len() > 0 && sl.Error() == nil {
-		if sl.Len() < minLen {
-			if debug {
-				dl.Println("ignoring padding")
-			}
-			// Padding
-			return trecs, drecs, sl.Error()
+	case setHdr.SetID > 3 && setHdr.SetID < 256:
+		// Reserved, shouldn't happen
+		if debug {
+			dl.Println("bad SetID", setHdr.SetID)
 		}
+		return ErrProtocol
 
-		// Set ID
-		//
-		// Identifies the Set.  A value of 2 is reserved for Template Sets. A
-		// value of 3 is reserved for Options Template Sets.  Values from 4 to
-		// 255 are reserved for future use.  Values 256 and above are used for
-		// Data Sets.  The Set ID values of 0 and 1 are not used, for
-		// historical reasons [RFC3954].
-
-		switch {
-		case setHdr.SetID < 2:
-			// Unused, shouldn't happen
-			if debug {
-				dl.Println("bad SetID", setHdr.SetID)
-			}
-			return nil, nil, ErrProtocol
+	default:
+		// Data set
+		if debug {
+			dl.Println("parsing data set")
+		}
+		return s.readDataSet(setHdr, sl, msg)
+	}
+}
 
-		case setHdr.SetID == 2:
-			// Template Set
-			if debug {
-				dl.Println("parsing template set")
-			}
-			tr := s.readTemplateRecord(sl)
-			s.registerTemplateRecord(&tr)
-			trecs = append(trecs, tr)
+func (s *Session) readTemplateSet(sl *slice, msg *Message) error {
+	size := sl.Len()
+	for i := 0; sl.Len() >= templateHeaderLength && sl.Error() == nil; i++ {
+		offset := size - sl.Len()
+		tr := s.readTemplateRecord(sl)
+		if err := sl.Error(); err != nil {
+			return recordError(err, offset, tr.TemplateID, i, "template record exceeds set")
+		}
 
-		case setHdr.SetID == 3:
-			// Options Template Set, not handled
-			if debug {
-				dl.Println("skipping option template set")
+		if len(tr.FieldSpecifiers) == 0 {
+			if w, ok := s.withdrawTemplate(msg.Header.DomainID, tr.TemplateID, false); ok {
+				msg.Withdrawals = append(msg.Withdrawals, w)
 			}
-			sl.Cut(sl.Len())
+			continue
+		}
 
-		case setHdr.SetID > 3 && setHdr.SetID < 256:
-			// Reserved, shouldn't happen
-			if debug {
-				dl.Println("bad SetID", setHdr.SetID)
-			}
-			return nil, nil, ErrProtocol
+		if !s.checkTemplate(tr.FieldSpecifiers, tr.TemplateID, msg) {
+			continue
+		}
 
-		default:
-			// Data set
-			if debug {
-				dl.Println("parsing data set")
-			}
-			tpl := s.lookupTemplateFieldSpecifiers(setHdr.SetID)
-
-			if tpl != nil {
-				// Data set
-				ds, err := s.readDataRecord(sl, tpl)
-				if err != nil {
-					return nil, nil, err
-				}
-				ds.TemplateID = s.unaliasTemplateID(setHdr.SetID)
-				drecs = append(drecs, ds)
-			} else {
-				// Data set with unknown template
-				// We can't trust set length, because we might be out of sync.
-				// Consume rest of message.
-				return trecs, drecs, sl.Error()
-			}
+		key := templateKey{msg.Header.DomainID, tr.TemplateID}
+		if err := s.registerTemplateRecord(msg.Header.DomainID, &tr); err != nil {
+			return recordError(err, offset, tr.TemplateID, i, "template not registered")
 		}
+		msg.TemplateRecords = append(msg.TemplateRecords, tr)
+		s.readPendingDataSets(key, msg)
 	}
 
-	return trecs, drecs, sl.Error()
-}
-
-func (s *Session) unaliasTemplateID(tid uint16) uint16 {
-	if s.withIDAliasing {
-		s.mut.RLock()
-		tid = s.aliases[tid]
-		s.mut.RUnlock()
+	if sl.Len() > 0 {
+		if debug {
+			dl.Println("ignoring padding")
+		}
+		atomic.AddUint64(&s.stats.paddingBytes, uint64(sl.Len()))
 	}
-	return tid
+	return sl.Error()
 }
 
-func (s *Session) readDataRecord(sl *slice, tpl []TemplateFieldSpecifier) (DataRecord, error) {
-	var dr DataRecord
-	dr.Fields = make([][]byte, len(tpl))
+func (s *Session) readOptionsTemplateSet(sl *slice, msg *Message) error {
+	size := sl.Len()
+	for i := 0; sl.Len() >= templateHeaderLength && sl.Error() == nil; i++ {
+		offset := size - sl.Len()
+		tr, fs, err := s.readOptionsTemplateRecord(sl)
+		if err != nil {
+			return recordError(err, offset, tr.TemplateID, i, "bad scope field count")
+		}
+		if err := sl.Error(); err != nil {
+			return recordError(err, offset, tr.TemplateID, i, "options template record exceeds set")
+		}
 
-	var err error
-	total := 0
-	for i := range tpl {
-		var val []byte
-		if tpl[i].Length == 65535 {
-			val, err = s.readVariableLength(sl)
-			if err != nil {
-				return DataRecord{}, err
+		if tr.ScopeFieldCount == 0 {
+			if w, ok := s.withdrawTemplate(msg.Header.DomainID, tr.TemplateID, true); ok {
+				msg.Withdrawals = append(msg.Withdrawals, w)
 			}
-		} else {
-			l := int(tpl[i].Length)
-			val = sl.Cut(l)
+			continue
 		}
-		dr.Fields[i] = val
-		total += len(val)
-	}
 
-	// The loop above keeps slices of the original buffer. But that buffer
-	// will be recycled so we need to copy them to separate storage. It's more
-	// efficient to do it this way, with a single allocation at the end than
-	// doing individual allocations along the way.
+		if !s.checkTemplate(fs, tr.TemplateID, msg) {
+			continue
+		}
 
-	cp := make([]byte, total)
-	next := 0
-	for i := range dr.Fields {
-		ln := copy(cp[next:], dr.Fields[i])
-		dr.Fields[i] = cp[next : next+ln]
-		next += ln
+		key := templateKey{msg.Header.DomainID, tr.TemplateID}
+		if err := s.registerOptionsTemplateRecord(msg.Header.DomainID, &tr); err != nil {
+			return recordError(err, offset, tr.TemplateID, i, "options template not registered")
+		}
+		msg.OptionsTemplateRecords = append(msg.OptionsTemplateRecords, tr)
+		s.readPendingDataSets(key, msg)
 	}
 
-	return dr, sl.Error()
+	if sl.Len() > 0 {
+		if debug {
+			dl.Println("ignoring padding")
+		}
+		atomic.AddUint64(&s.stats.paddingBytes, uint64(sl.Len()))
+	}
+	return sl.Error()
 }
 
-func (s *Session) readTemplateRecord(sl *slice) TemplateRecord {
-	var th templateHeader
-	th.unmarshal(sl)
-	if debug {
-		dl.Printf("templateHeader: %+v", th)
+func (s *Session) readDataSet(setHdr setHeader, sl *slice, msg *Message) error {
+	domainID := msg.Header.DomainID
+	tpl, tid := s.dataSetTemplate(templateKey{domainID, setHdr.SetID}, sl.bytes())
+	if tpl == nil {
+		msg.unknownSets++
+		return sl.Error()
 	}
 
-	var tr TemplateRecord
-	tr.TemplateID = th.TemplateID
-	tr.FieldSpecifiers = make([]TemplateFieldSpecifier, th.FieldCount)
-	for i := 0; i < int(th.FieldCount); i++ {
-		f := TemplateFieldSpecifier{}
-		f.FieldID = sl.Uint16()
-		f.Length = sl.Uint16()
-		if f.FieldID >= 0x8000 {
-			f.FieldID -= 0x8000
-			f.EnterpriseID = sl.Uint32()
+	size := sl.Len()
+	for i := 0; sl.Len() > 0 && sl.Error() == nil; i++ {
+		offset := size - sl.Len()
+		if sl.Len() < int(tpl.minRecord) {
+			if debug {
+				dl.Println("ignoring padding")
+			}
+			// Padding
+			atomic.AddUint64(&s.stats.paddingBytes, uint64(sl.Len()))
+			break
 		}
-		tr.FieldSpecifiers[i] = f
-	}
-
-	return tr
-}
 
-func (s *Session) registerTemplateRecord(tr *TemplateRecord) {
-	if s.withIDAliasing {
-		tr.TemplateID = s.registerAliasedTemplateRecord(*tr)
-	} else {
-		s.registerUnaliasedTemplateRecord(*tr)
+		ds, err := s.readDataRecord(sl, tpl.specifiers, msg.noCopy)
+		if err != nil {
+			return recordError(err, offset, setHdr.SetID, i, "data record exceeds set")
+		}
+		ds.DomainID = domainID
+		ds.TemplateID = tid
+
+		if tpl.scopeFields > 0 {
+			// Options data set
+			msg.OptionsDataRecords = append(msg.OptionsDataRecords, OptionsDataRecord{
+				DomainID:    ds.DomainID,
+				TemplateID:  ds.TemplateID,
+				ScopeFields: ds.Fields[:tpl.scopeFields:tpl.scopeFields],
+				Fields:      ds.Fields[tpl.scopeFields:],
+			})
+		} else {
+			msg.DataRecords = append(msg.DataRecords, ds)
+		}
 	}
-}
 
-func (s *Session) registerUnaliasedTemplateRecord(tr TemplateRecord) {
-	// Update templates and minimum record cache
-	tid := tr.TemplateID
-	tpl := tr.FieldSpecifiers
-	minLen := calcMinRecLen(tpl)
-	s.mut.Lock()
-	defer s.mut.Unlock()
-	if minLen == 0 {
-		delete(s.specifiers, tid)
-	} else {
-		s.specifiers[tid] = tpl
-	}
-	s.minRecord[tid] = minLen
+	return sl.Error()
 }
 
-func (s *Session) registerAliasedTemplateRecord(tr TemplateRecord) uint16 {
-	var tid uint16
-	if len(tr.FieldSpecifiers) == 0 {
-		s.withdrawAliasedTemplateRecord(tr)
-		tid = tr.TemplateID
-	} else {
-		tid = s.aliasTemplateRecord(tr)
+// dataSetTemplate returns the template describing a data set and the
+// template ID its records carry. A data set with an unknown template is
+// counted, and kept until the template arrives if WithPendingDataSets is
+// enabled; nil is returned for it.
+func (s *Session) dataSetTemplate(key templateKey, set []byte) (*template, uint16) {
+	tpl := s.lookupTemplate(key)
+	if tpl == nil {
+		if debug {
+			dl.Println("unknown template", key.templateID)
+		}
+		atomic.AddUint64(&s.stats.unknownTemplateSets, 1)
+		if s.pending.enabled() {
+			s.pending.add(key, set, s.now())
+		}
+		return nil, 0
 	}
 
-	if debug {
-		dl.Printf("Mapped template id %d -> %d", tr.TemplateID, tid)
+	if s.withIDAliasing {
+		return tpl, tpl.alias
 	}
-	return tid
+	return tpl, key.templateID
 }
 
-func (s *Session) aliasTemplateRecord(tr TemplateRecord) uint16 {
-	var buffer bytes.Buffer
-	binary.Write(&buffer, binary.BigEndian, tr.FieldSpecifiers)
-	hash := sha1.Sum(buffer.Bytes())
-
-	var ntid uint16
-	s.mut.Lock()
-	defer s.mut.Unlock()
-
-	if id, ok := s.signatures[hash]; ok {
-		ntid = id
-	} else {
-		ntid = s.nextID
-		s.signatures[hash] = ntid
-		s.specifiers[ntid] = tr.FieldSpecifiers
-		s.nextID++
+func (s *Session) readDataRecord(sl *slice, tpl []TemplateFieldSpecifier, noCopy bool) (DataRecord, error) {
+	var dr DataRecord
+	var err error
+	dr.Fields, err = s.readFields(sl, tpl, make([][]byte, 0, len(tpl)))
+	if err != nil {
+		return DataRecord{}, err
+	}
 
-		if s.nextID == 65535 {
-			panic("IPFIX has run out of virtual template ids!")
-		}
+	// The loop above keeps slices of the original buffer. But that buffer
+	// will be recycled so we need to copy them to separate storage, unless
+	// the caller has promised not to. It's more efficient to do it this way,
+	// with a single allocation at the end than doing individual allocations
+	// along the way.
 
-		s.minRecord[ntid] = calcMinRecLen(tr.FieldSpecifiers)
+	if noCopy {
+		return dr, nil
 	}
 
-	if _, ok := s.aliases[tr.TemplateID]; !ok {
-		s.aliases[tr.TemplateID] = ntid
+	total := 0
+	for _, val := range dr.Fields {
+		total += len(val)
+	}
+	cp := make([]byte, total)
+	next := 0
+	for i := range dr.Fields {
+		ln := copy(cp[next:], dr.Fields[i])
+		dr.Fields[i] = cp[next : next+ln]
+		next += ln
 	}
 
-	return ntid
-}
-
-func (s *Session) withdrawAliasedTemplateRecord(tr TemplateRecord) {
-	s.mut.Lock()
-	defer s.mut.Unlock()
-	delete(s.aliases, tr.TemplateID)
+	return dr, nil
 }
 
-func calcMinRecLen(tpl []TemplateFieldSpecifier) uint16 {
-	var minLen uint16
+// readFields slices the fields of one record described by tpl from sl,
+// appending them to fields.
+func (s *Session) readFields(sl *slice, tpl []TemplateFieldSpecifier, fields [][]byte) ([][]byte, error) {
 	for i := range tpl {
+		var val []byte
 		if tpl[i].Length == 65535 {
-			minLen++
+			var err error
+			val, err = s.readVariableLength(sl)
+			if err != nil {
+				return fields, err
+			}
 		} else {
-			minLen += tpl[i].Length
+			val = sl.Cut(int(tpl[i].Length))
 		}
+		fields = append(fields, val)
 	}
-	return minLen
+	return fields, sl.Error()
 }
 
-func (s *Session) lookupTemplateFieldSpecifiers(tid uint16) []TemplateFieldSpecifier {
-	var tpl []TemplateFieldSpecifier
-
-	if s.withIDAliasing {
-		tpl = s.lookupAliasedTemplateFieldSpecifiers(tid)
-	} else {
-		tpl = s.lookupUnaliasedTemplateFieldSpecifiers(tid)
+func (s *Session) readTemplateRecord(sl *slice) TemplateRecord {
+	var th templateHeader
+	th.unmarshal(sl)
+	if debug {
+		dl.Printf("templateHeader: %+v", th)
 	}
 
-	return tpl
-}
+	var tr TemplateRecord
+	tr.TemplateID = th.TemplateID
+	tr.FieldSpecifiers = s.readFieldSpecifiers(sl, th.FieldCount)
 
-func (s *Session) lookupUnaliasedTemplateFieldSpecifiers(tid uint16) []TemplateFieldSpecifier {
-	var tpl []TemplateFieldSpecifier
+	return tr
+}
 
-	s.mut.RLock()
-	defer s.mut.RUnlock()
-	if id, ok := s.specifiers[tid]; ok {
-		tpl = id
+// readOptionsTemplateRecord reads an options template record, returning it
+// and all its field specifiers, scope fields first.
+func (s *Session) readOptionsTemplateRecord(sl *slice) (OptionsTemplateRecord, []TemplateFieldSpecifier, error) {
+	var th optionsTemplateHeader
+	th.unmarshal(sl)
+	if debug {
+		dl.Printf("optionsTemplateHeader: %+v", th)
 	}
 
-	return tpl
-}
+	if th.ScopeFieldCount > th.FieldCount || th.FieldCount > 0 && th.ScopeFieldCount == 0 {
+		// An options template must have at least one scope field
+		if debug {
+			dl.Println("bad scope field count", th.ScopeFieldCount)
+		}
+		return OptionsTemplateRecord{TemplateID: th.TemplateID}, nil, ErrProtocol
+	}
 
-func (s *Session) lookupAliasedTemplateFieldSpecifiers(tid uint16) []TemplateFieldSpecifier {
-	var tpl []TemplateFieldSpecifier
+	fs := s.readFieldSpecifiers(sl, th.FieldCount)
 
-	s.mut.RLock()
-	if id, ok := s.aliases[tid]; ok {
-		tpl = s.specifiers[id]
-	}
-	s.mut.RUnlock()
+	var tr OptionsTemplateRecord
+	tr.TemplateID = th.TemplateID
+	tr.ScopeFieldCount = th.ScopeFieldCount
+	tr.ScopeFieldSpecifiers = fs[:th.ScopeFieldCount:th.ScopeFieldCount]
+	tr.FieldSpecifiers = fs[th.ScopeFieldCount:]
 
-	return tpl
+	return tr, fs, nil
 }
 
-func (s *Session) getMinRecLen(tid uint16) uint16 {
-	var minLen uint16
-
-	s.mut.RLock()
-	defer s.mut.RUnlock()
-	if s.withIDAliasing {
-		minLen = s.minRecord[s.aliases[tid]]
-	} else {
-		minLen = s.minRecord[tid]
+func (s *Session) readFieldSpecifiers(sl *slice, count uint16) []TemplateFieldSpecifier {
+	fs := make([]TemplateFieldSpecifier, count)
+	for i := range fs {
+		f := TemplateFieldSpecifier{}
+		f.FieldID = sl.Uint16()
+		f.Length = sl.Uint16()
+		if f.FieldID >= 0x8000 {
+			f.FieldID -= 0x8000
+			f.EnterpriseID = sl.Uint32()
+		}
+		fs[i] = f
 	}
-
-	return minLen
+	return fs
 }
 
 func (s *Session) readVariableLength(sl *slice) (val []byte, err error) {
@@ -3,6 +3,7 @@ package ipfix_test
 import (
 	"bytes"
 	"encoding/hex"
+	"errors"
 	"io"
 	"sync"
 	"testing"
@@ -334,6 +335,29 @@ func BenchmarkParseBuffer(b *testing.B) {
 	}
 }
 
+func BenchmarkParseBufferNoCopy(b *testing.B) {
+	p0, _ := hex.DecodeString("000a008c51ec4264000000000b20bdbe0002007c283b0008001c0010800c000400003c258003000800003c258004000800003c258012ffff00003c258001ffff00003c25801cffff00003c25001b0010c2ac0008000c0004800c000400003c258003000800003c258004000800003c258012ffff00003c258001ffff00003c25801cffff00003c2500080004")
+	p1, _ := hex.DecodeString("000a05b051ec4270000000000b20bdbec2ac05a0ac10200f0000000000000000000000910000000000000136000f426974546f7272656e74204b525043000116fcb8ac10200f00000000000000000000008c000000000000013a000f426974546f7272656e74204b525043005e489f46ac10200300000026000000000000019f0000000000000160000e4265696e6720616e616c797a656400c27ef905ac10200f0000000000000000000000910000000000000136000f426974546f7272656e74204b525043007aa7519c0808080800000000000000000000008d00000000000000550003444e5300ac102082ac10200f0000000000000000000000940000000000000147000f426974546f7272656e74204b52504300b228265c1859c1570000000000000000000000000000000000000064000f426974546f7272656e74204b52504300ac10200fac10200f0000000000000000000000920000000000000145000f426974546f7272656e74204b525043007b75a68ad92bb37f00000000000000000000006e0000000000000064000f426974546f7272656e74204b52504300ac10200fac10200f0000000000000000000000910000000000000136000f426974546f7272656e74204b525043004f972c247449d8f200000000000000000000006e0000000000000064000f426974546f7272656e74204b52504300ac10200fac10200f0000000000000000000000910000000000000136000f426974546f7272656e74204b5250430048b682a4ac10200f00000000000000000000008c000000000000013a000f426974546f7272656e74204b52504300595cc40dac10200f0000000000000000000000910000000000000136000f426974546f7272656e74204b5250430057451cc1ac10200f00000000000000000000008c000000000000013a000f426974546f7272656e74204b525043005465e5a8ac1020ff00000000000000000000000000000000000000af001a44726f70626f78204c414e2073796e6320646973636f766572790764726f70626f78ac102013ac10200f00000000000000000000008f000000000000014b000f426974546f7272656e74204b5250430001ab3c06ac10200f00000000000000000000008c000000000000013a000f426974546f7272656e74204b52504300befcacc8ffffffff00000000000000000000000000000000000000af001a44726f70626f78204c414e2073796e6320646973636f766572790764726f70626f78ac102013ac10200300000025000000000000019e0000000000000167000e4265696e6720616e616c797a656400c27ef905ac10200f0000000000000000000000910000000000000136000f426974546f7272656e74204b525043006ca28bcdac10200f000000000000000000000091000000000000011c000f426974546f7272656e74204b52504300b13531caac10200f000000000000000000000068000000000000005f000f426974546f7272656e74204b5250430053df9212ac10200f0000000000000000000000940000000000000159000f426974546f7272656e74204b525043005f43f0b2ac10200f0000000000000000000001220000000000000252000f426974546f7272656e74204b52504300567ce6fbac10200100000000000000000000005a000000000000005a00034e545000ac102080ac10200f00000000000000000000008c000000000000013a000f426974546f7272656e74204b5250430055550ef7ac10200f0000000000000000000000910000000000000136000f426974546f7272656e74204b52504300ba9322a2ac10200f0000000000000000000000910000000000000136000f426974546f7272656e74204b525043004579e7114b01bf5300000000000000000000006e0000000000000064000f426974546f7272656e74204b52504300ac10200fac10200f0000000000000000000000910000000000000136000f426974546f7272656e74204b525043005cf46adf")
+
+	p := ipfix.NewSession()
+	_, err := p.ParseBuffer(p0)
+	if err != nil {
+		b.Fatal("ParseReader failed", err)
+	}
+
+	b.ResetTimer()
+	b.ReportAllocs()
+	b.SetBytes(1)
+
+	for i := 0; i < b.N; {
+		msg, err = p.ParseBufferNoCopy(p1)
+		if err != nil {
+			b.Error("ParseReader failed", err)
+		}
+		i += len(msg.DataRecords) + len(msg.TemplateRecords)
+	}
+}
+
 func TestParsingTemplateAndDataRecords(t *testing.T) {
 	packet, _ := hex.DecodeString("000a00405685b3700000000000bc614e000200140100000300080004000c0004000200040100001cc0a800c9c0a80001000000ebc0a800cac0a800010000002a")
 	p := ipfix.NewSession()
@@ -350,3 +374,328 @@ func TestParsingTemplateAndDataRecords(t *testing.T) {
 		t.Error("Incorrect number of data records", len(msg.DataRecords))
 	}
 }
+
+func TestParseOptionsTemplateSet(t *testing.T) {
+	packet, _ := hex.DecodeString("000a003800000000000000000000000100030018010000030001009500040022000400230001000001000010000000010000006401000000")
+	p := ipfix.NewSession()
+
+	msg, err := p.ParseBuffer(packet)
+	if err != nil {
+		t.Fatal("ParseBuffer failed", err)
+	}
+
+	if len(msg.TemplateRecords) != 0 {
+		t.Error("Incorrect number of template records", len(msg.TemplateRecords))
+	}
+	if len(msg.OptionsTemplateRecords) != 1 {
+		t.Fatal("Incorrect number of options template records", len(msg.OptionsTemplateRecords))
+	}
+
+	tr := msg.OptionsTemplateRecords[0]
+	if tr.TemplateID != 256 {
+		t.Error("Incorrect template ID", tr.TemplateID)
+	}
+	if tr.ScopeFieldCount != 1 || len(tr.ScopeFieldSpecifiers) != 1 {
+		t.Error("Incorrect number of scope fields", tr.ScopeFieldCount, len(tr.ScopeFieldSpecifiers))
+	}
+	if id := tr.ScopeFieldSpecifiers[0].FieldID; id != 149 {
+		t.Error("Incorrect scope field ID", id)
+	}
+	if len(tr.FieldSpecifiers) != 2 {
+		t.Error("Incorrect number of option fields", len(tr.FieldSpecifiers))
+	}
+
+	if len(msg.DataRecords) != 0 {
+		t.Error("Incorrect number of data records", len(msg.DataRecords))
+	}
+	if len(msg.OptionsDataRecords) != 1 {
+		t.Fatal("Incorrect number of options data records", len(msg.OptionsDataRecords))
+	}
+	if l := len(msg.OptionsDataRecords[0].ScopeFields); l != 1 {
+		t.Error("Incorrect number of scope fields", l)
+	}
+	if l := len(msg.OptionsDataRecords[0].Fields); l != 2 {
+		t.Error("Incorrect number of fields", l)
+	}
+}
+
+func TestTemplatesPerDomain(t *testing.T) {
+	testTemplatesPerDomain(false, t)
+}
+
+func TestTemplatesPerDomainWithAliasing(t *testing.T) {
+	testTemplatesPerDomain(true, t)
+}
+
+func testTemplatesPerDomain(withAliasing bool, t *testing.T) {
+	// Domains 1 and 2 both use template ID 256, with different layouts
+	t1, _ := hex.DecodeString("000a0020000000000000000000000001000200100100000200080004000c0004")
+	t2, _ := hex.DecodeString("000a001c0000000000000000000000020002000c0100000100070002")
+	d1, _ := hex.DecodeString("000a001c0000000000000000000000010100000c0a0000010a000002")
+	d2, _ := hex.DecodeString("000a00180000000000000000000000020100000800500051")
+
+	p := ipfix.NewSession(ipfix.WithIDAliasing(withAliasing))
+	i := ipfix.NewInterpreter(p)
+
+	for _, bs := range [][]byte{t1, t2} {
+		if _, err := p.ParseBuffer(bs); err != nil {
+			t.Fatal("ParseBuffer failed", err)
+		}
+	}
+
+	msg, err := p.ParseBuffer(d1)
+	if err != nil {
+		t.Fatal("ParseBuffer failed", err)
+	}
+	if len(msg.DataRecords) != 1 {
+		t.Fatal("Incorrect number of data records", len(msg.DataRecords))
+	}
+	if id := msg.DataRecords[0].DomainID; id != 1 {
+		t.Error("Incorrect domain ID", id)
+	}
+	fl := i.Interpret(msg.DataRecords[0])
+	if len(fl) != 2 || fl[0].Name != "sourceIPv4Address" || fl[1].Name != "destinationIPv4Address" {
+		t.Errorf("Incorrect interpretation for domain 1: %v", fl)
+	}
+
+	msg, err = p.ParseBuffer(d2)
+	if err != nil {
+		t.Fatal("ParseBuffer failed", err)
+	}
+	if len(msg.DataRecords) != 2 {
+		t.Fatal("Incorrect number of data records", len(msg.DataRecords))
+	}
+	if id := msg.DataRecords[0].DomainID; id != 2 {
+		t.Error("Incorrect domain ID", id)
+	}
+	fl = i.Interpret(msg.DataRecords[1])
+	if len(fl) != 1 || fl[0].Name != "sourceTransportPort" || fl[0].Value != uint16(81) {
+		t.Errorf("Incorrect interpretation for domain 2: %v", fl)
+	}
+}
+
+func TestParseBufferNoCopy(t *testing.T) {
+	packet, _ := hex.DecodeString("000a00405685b3700000000000bc614e000200140100000300080004000c0004000200040100001cc0a800c9c0a80001000000ebc0a800cac0a800010000002a")
+	p := ipfix.NewSession()
+
+	msg, err := p.ParseBufferNoCopy(packet)
+	if err != nil {
+		t.Fatal("ParseBufferNoCopy failed", err)
+	}
+	if len(msg.DataRecords) != 2 {
+		t.Fatal("Incorrect number of data records", len(msg.DataRecords))
+	}
+
+	// The fields are slices of the packet
+	field := msg.DataRecords[1].Fields[2]
+	packet[len(packet)-1] = 0x2b
+	if !bytes.Equal(field, []byte{0, 0, 0, 0x2b}) {
+		t.Errorf("Field %x does not alias the buffer", field)
+	}
+}
+
+func BenchmarkRecordCursor(b *testing.B) {
+	p0, _ := hex.DecodeString("000a008c51ec4264000000000b20bdbe0002007c283b0008001c0010800c000400003c258003000800003c258004000800003c258012ffff00003c258001ffff00003c25801cffff00003c25001b0010c2ac0008000c0004800c000400003c258003000800003c258004000800003c258012ffff00003c258001ffff00003c25801cffff00003c2500080004")
+	p1, _ := hex.DecodeString("000a05b051ec4270000000000b20bdbec2ac05a0ac10200f0000000000000000000000910000000000000136000f426974546f7272656e74204b525043000116fcb8ac10200f00000000000000000000008c000000000000013a000f426974546f7272656e74204b525043005e489f46ac10200300000026000000000000019f0000000000000160000e4265696e6720616e616c797a656400c27ef905ac10200f0000000000000000000000910000000000000136000f426974546f7272656e74204b525043007aa7519c0808080800000000000000000000008d00000000000000550003444e5300ac102082ac10200f0000000000000000000000940000000000000147000f426974546f7272656e74204b52504300b228265c1859c1570000000000000000000000000000000000000064000f426974546f7272656e74204b52504300ac10200fac10200f0000000000000000000000920000000000000145000f426974546f7272656e74204b525043007b75a68ad92bb37f00000000000000000000006e0000000000000064000f426974546f7272656e74204b52504300ac10200fac10200f0000000000000000000000910000000000000136000f426974546f7272656e74204b525043004f972c247449d8f200000000000000000000006e0000000000000064000f426974546f7272656e74204b52504300ac10200fac10200f0000000000000000000000910000000000000136000f426974546f7272656e74204b5250430048b682a4ac10200f00000000000000000000008c000000000000013a000f426974546f7272656e74204b52504300595cc40dac10200f0000000000000000000000910000000000000136000f426974546f7272656e74204b5250430057451cc1ac10200f00000000000000000000008c000000000000013a000f426974546f7272656e74204b525043005465e5a8ac1020ff00000000000000000000000000000000000000af001a44726f70626f78204c414e2073796e6320646973636f766572790764726f70626f78ac102013ac10200f00000000000000000000008f000000000000014b000f426974546f7272656e74204b5250430001ab3c06ac10200f00000000000000000000008c000000000000013a000f426974546f7272656e74204b52504300befcacc8ffffffff00000000000000000000000000000000000000af001a44726f70626f78204c414e2073796e6320646973636f766572790764726f70626f78ac102013ac10200300000025000000000000019e0000000000000167000e4265696e6720616e616c797a656400c27ef905ac10200f0000000000000000000000910000000000000136000f426974546f7272656e74204b525043006ca28bcdac10200f000000000000000000000091000000000000011c000f426974546f7272656e74204b52504300b13531caac10200f000000000000000000000068000000000000005f000f426974546f7272656e74204b5250430053df9212ac10200f0000000000000000000000940000000000000159000f426974546f7272656e74204b525043005f43f0b2ac10200f0000000000000000000001220000000000000252000f426974546f7272656e74204b52504300567ce6fbac10200100000000000000000000005a000000000000005a00034e545000ac102080ac10200f00000000000000000000008c000000000000013a000f426974546f7272656e74204b5250430055550ef7ac10200f0000000000000000000000910000000000000136000f426974546f7272656e74204b52504300ba9322a2ac10200f0000000000000000000000910000000000000136000f426974546f7272656e74204b525043004579e7114b01bf5300000000000000000000006e0000000000000064000f426974546f7272656e74204b52504300ac10200fac10200f0000000000000000000000910000000000000136000f426974546f7272656e74204b525043005cf46adf")
+
+	p := ipfix.NewSession()
+	_, err := p.ParseBuffer(p0)
+	if err != nil {
+		b.Fatal("ParseReader failed", err)
+	}
+
+	b.ResetTimer()
+	b.ReportAllocs()
+	b.SetBytes(1)
+
+	c := p.Records(p1)
+	for i := 0; i < b.N; {
+		c.Reset(p1)
+		for c.Next() {
+			c.Record()
+			i++
+		}
+		if err := c.Err(); err != nil {
+			b.Error("Cursor failed", err)
+		}
+	}
+}
+
+func TestParseError(t *testing.T) {
+	// The second record claims a ten byte interface name, with three bytes
+	// left in the set.
+	packet, _ := hex.DecodeString("000a00270000000000000000000000010002000c010100010052ffff0101000b0261620a616263")
+
+	p := ipfix.NewSession()
+	_, err := p.ParseBuffer(packet)
+	if !errors.Is(err, ipfix.ErrRead) {
+		t.Fatalf("Received %v instead of ipfix.ErrRead error", err)
+	}
+
+	var pe *ipfix.ParseError
+	if !errors.As(err, &pe) {
+		t.Fatalf("Received %T instead of *ipfix.ParseError", err)
+	}
+	if pe.Offset != 35 {
+		t.Error("Incorrect offset", pe.Offset)
+	}
+	if pe.SetID != 257 || pe.TemplateID != 257 {
+		t.Errorf("Incorrect set/template ID %d/%d", pe.SetID, pe.TemplateID)
+	}
+	if pe.Record != 1 {
+		t.Error("Incorrect record index", pe.Record)
+	}
+
+	c := ipfix.NewSession().Records(packet)
+	for c.Next() {
+		c.Record()
+	}
+	var cpe *ipfix.ParseError
+	if !errors.As(c.Err(), &cpe) || *cpe != *pe {
+		t.Errorf("Cursor error %v differs from %v", c.Err(), pe)
+	}
+}
+
+func TestParseErrorSet(t *testing.T) {
+	// Set ID 4 is reserved
+	packet, _ := hex.DecodeString("000a0020000000000000000000000001000400100100000200080004000c0004")
+
+	_, err := ipfix.NewSession().ParseBuffer(packet)
+	if !errors.Is(err, ipfix.ErrProtocol) {
+		t.Fatalf("Received %v instead of ipfix.ErrProtocol error", err)
+	}
+	var pe *ipfix.ParseError
+	if !errors.As(err, &pe) {
+		t.Fatalf("Received %T instead of *ipfix.ParseError", err)
+	}
+	if pe.Offset != 16 || pe.SetID != 4 || pe.Record != -1 {
+		t.Errorf("Incorrect error context %+v", pe)
+	}
+}
+
+func TestLenientParsing(t *testing.T) {
+	// Three data sets, the second of which has a record claiming a ten byte
+	// interface name with three bytes left in the set.
+	packet, _ := hex.DecodeString("000a00340000000000000000000000010002000c010100010052ffff010100070261620101000b0261620a616263010100060163")
+
+	_, err := ipfix.NewSession().ParseBuffer(packet)
+	if !errors.Is(err, ipfix.ErrRead) {
+		t.Fatalf("Received %v instead of ipfix.ErrRead error", err)
+	}
+
+	p := ipfix.NewSession(ipfix.WithLenientParsing(true))
+	msg, err := p.ParseBuffer(packet)
+	if err != nil {
+		t.Fatal("ParseBuffer failed", err)
+	}
+	if len(msg.DataRecords) != 2 {
+		t.Fatal("Incorrect number of data records", len(msg.DataRecords))
+	}
+	if string(msg.DataRecords[0].Fields[0]) != "ab" || string(msg.DataRecords[1].Fields[0]) != "c" {
+		t.Errorf("Incorrect data records %q, %q", msg.DataRecords[0].Fields[0], msg.DataRecords[1].Fields[0])
+	}
+	if len(msg.Errors) != 1 {
+		t.Fatal("Incorrect number of errors", len(msg.Errors))
+	}
+	var pe *ipfix.ParseError
+	if !errors.As(msg.Errors[0], &pe) || pe.Offset != 42 || pe.Record != 1 {
+		t.Errorf("Incorrect error %v", msg.Errors[0])
+	}
+
+	// A set running past the end of the message ends it
+	packet = append(packet[:len(packet)-6], 0x01, 0x01, 0x00, 0x10)
+	packet[3] = byte(len(packet))
+	msg, err = p.ParseBuffer(packet)
+	if err != nil {
+		t.Fatal("ParseBuffer failed", err)
+	}
+	if len(msg.DataRecords) != 1 || len(msg.Errors) != 2 {
+		t.Errorf("Incorrect number of data records %d or errors %d", len(msg.DataRecords), len(msg.Errors))
+	}
+}
+
+func TestParseBufferHeader(t *testing.T) {
+	packet, _ := hex.DecodeString("000a0020000000000000000000000001000200100100000200080004000c0004")
+	p := ipfix.NewSession()
+
+	// Trailing bytes are not parsed as sets
+	msg, err := p.ParseBuffer(append(packet, 0xff, 0xff, 0xff))
+	if err != nil {
+		t.Fatal("ParseBuffer failed", err)
+	}
+	if len(msg.TemplateRecords) != 1 {
+		t.Error("Incorrect number of template records", len(msg.TemplateRecords))
+	}
+
+	if _, err := p.ParseBuffer(packet[:len(packet)-1]); err != io.ErrUnexpectedEOF {
+		t.Errorf("Received %v instead of io.ErrUnexpectedEOF for short buffer", err)
+	}
+	if _, err := p.ParseBuffer(packet[:10]); err != io.ErrUnexpectedEOF {
+		t.Errorf("Received %v instead of io.ErrUnexpectedEOF for short header", err)
+	}
+
+	bad := append([]byte{}, packet...)
+	bad[1] = 9
+	if _, err := p.ParseBuffer(bad); err != ipfix.ErrVersion {
+		t.Errorf("Received %v instead of ipfix.ErrVersion", err)
+	}
+
+	bad[1], bad[3] = 10, 8
+	if _, err := p.ParseBuffer(bad); err != io.ErrUnexpectedEOF {
+		t.Errorf("Received %v instead of io.ErrUnexpectedEOF for short length", err)
+	}
+}
+
+func TestParseBufferAll(t *testing.T) {
+	// A template message and a data message in one buffer
+	packet, _ := hex.DecodeString("000a0020000000000000000000000001000200100100000200080004000c0004000a001c0000000000000000000000010100000c0a0000010a000002")
+	p := ipfix.NewSession()
+
+	msgs, err := p.ParseBufferAll(packet)
+	if err != nil {
+		t.Fatal("ParseBufferAll failed", err)
+	}
+	if len(msgs) != 2 {
+		t.Fatal("Incorrect number of messages", len(msgs))
+	}
+	if len(msgs[0].TemplateRecords) != 1 || len(msgs[1].DataRecords) != 1 {
+		t.Errorf("Incorrect number of template %d or data records %d", len(msgs[0].TemplateRecords), len(msgs[1].DataRecords))
+	}
+
+	// A truncated second message
+	msgs, err = p.ParseBufferAll(packet[:len(packet)-1])
+	if err != io.ErrUnexpectedEOF {
+		t.Errorf("Received %v instead of io.ErrUnexpectedEOF", err)
+	}
+	if len(msgs) != 1 {
+		t.Error("Incorrect number of messages", len(msgs))
+	}
+}
+
+func TestOptionsScopeCapacity(t *testing.T) {
+	packet, _ := hex.DecodeString("000a003800000000000000000000000100030018010000030001009500040022000400230001000001000010000000010000006401000000")
+
+	p := ipfix.NewSession()
+	msg, err := p.ParseBuffer(packet)
+	if err != nil {
+		t.Fatal("ParseBuffer failed", err)
+	}
+	if len(msg.OptionsTemplateRecords) != 1 || len(msg.OptionsDataRecords) != 1 {
+		t.Fatalf("Incorrect number of options template %d or data records %d", len(msg.OptionsTemplateRecords), len(msg.OptionsDataRecords))
+	}
+
+	// Appending to the scope must not overwrite what follows it
+	tr := msg.OptionsTemplateRecords[0]
+	field := tr.FieldSpecifiers[0]
+	_ = append(tr.ScopeFieldSpecifiers, ipfix.TemplateFieldSpecifier{FieldID: 1})
+	if tr.FieldSpecifiers[0] != field {
+		t.Error("Scope field specifiers share capacity with field specifiers")
+	}
+
+	rec := msg.OptionsDataRecords[0]
+	value := rec.Fields[0]
+	_ = append(rec.ScopeFields, nil)
+	if rec.Fields[0] == nil || &rec.Fields[0][0] != &value[0] {
+		t.Error("Scope fields share capacity with fields")
+	}
+}
@@ -0,0 +1,264 @@
+package ipfix
+
+import (
+	"sync"
+	"time"
+)
+
+// WithPendingDataSets enables buffering of data sets that arrive before their
+// template, as happens after a collector restart. Up to maxSets data sets are
+// kept per template ID for at most timeout; a timeout of zero keeps them
+// until they overflow. The total size of the buffered sets is limited as set
+// by WithPendingDataSetsLimit. When the template arrives, the buffered sets
+// are decoded and returned in the Message that carried the template. The
+// default is disabled.
+func WithPendingDataSets(maxSets int, timeout time.Duration) Option {
+	return func(s *Session) {
+		s.pending.maxSets = maxSets
+		s.pending.timeout = timeout
+	}
+}
+
+// The default limit on the total size of buffered data sets.
+const defaultPendingBytes = 16 << 20
+
+// WithPendingDataSetsLimit sets the limit on the total size in bytes of the
+// data sets buffered with WithPendingDataSets, across all templates. When
+// the limit is reached the oldest buffered sets are dropped. The default is
+// 16 MiB.
+func WithPendingDataSetsLimit(maxBytes int) Option {
+	return func(s *Session) {
+		s.pending.maxBytes = maxBytes
+	}
+}
+
+// PendingStats are the counters for data sets buffered while waiting for
+// their template.
+type PendingStats struct {
+	Buffered  uint64 // Data sets buffered
+	Recovered uint64 // Buffered data sets decoded once the template arrived
+	Dropped   uint64 // Buffered data sets dropped due to overflow or timeout
+}
+
+type pendingSet struct {
+	data     []byte
+	received time.Time
+	id       uint64
+}
+
+// pendingRef refers to a buffered set, in the order the sets were added.
+type pendingRef struct {
+	key templateKey
+	id  uint64
+}
+
+type pendingCache struct {
+	maxSets  int
+	maxBytes int
+	timeout  time.Duration
+
+	mut    sync.Mutex
+	sets   map[templateKey][]pendingSet
+	count  int          // number of buffered sets
+	size   int          // bytes in buffered sets
+	order  []pendingRef // may refer to sets that have since been removed
+	nextID uint64
+	stats  PendingStats
+}
+
+func (c *pendingCache) enabled() bool {
+	return c.maxSets > 0
+}
+
+// add buffers a copy of the data set, dropping the oldest set for the
+// template if there are too many, and the oldest sets in the cache if it is
+// full.
+func (c *pendingCache) add(key templateKey, data []byte, now time.Time) {
+	c.mut.Lock()
+	defer c.mut.Unlock()
+
+	if c.sets == nil {
+		c.sets = make(map[templateKey][]pendingSet)
+	}
+
+	maxBytes := c.maxBytes
+	if maxBytes <= 0 {
+		maxBytes = defaultPendingBytes
+	}
+	if len(data) > maxBytes {
+		c.stats.Dropped++
+		return
+	}
+
+	if sets := c.sets[key]; len(sets) >= c.maxSets {
+		c.removed(sets[0])
+		c.sets[key] = sets[1:]
+		c.stats.Dropped++
+	}
+	for c.size+len(data) > maxBytes && c.count > 0 {
+		c.dropOldest()
+	}
+
+	cp := make([]byte, len(data))
+	copy(cp, data)
+	c.nextID++
+	c.sets[key] = append(c.sets[key], pendingSet{cp, now, c.nextID})
+	c.order = append(c.order, pendingRef{key, c.nextID})
+	c.count++
+	c.size += len(cp)
+	c.stats.Buffered++
+
+	if debug {
+		dl.Printf("buffered data set for template %d/%d (%d pending)", key.domainID, key.templateID, len(c.sets[key]))
+	}
+}
+
+// take removes and returns the data sets buffered for the template that have
+// not timed out.
+func (c *pendingCache) take(key templateKey, now time.Time) [][]byte {
+	c.mut.Lock()
+	defer c.mut.Unlock()
+
+	sets, ok := c.sets[key]
+	if !ok {
+		return nil
+	}
+	delete(c.sets, key)
+
+	var res [][]byte
+	for _, set := range sets {
+		c.removed(set)
+		if c.isExpired(set, now) {
+			c.stats.Dropped++
+			continue
+		}
+		res = append(res, set.data)
+	}
+	return res
+}
+
+// expire drops all data sets that have timed out.
+func (c *pendingCache) expire(now time.Time) {
+	c.mut.Lock()
+	defer c.mut.Unlock()
+
+	for key, sets := range c.sets {
+		i := 0
+		for i < len(sets) && c.isExpired(sets[i], now) {
+			c.removed(sets[i])
+			i++
+		}
+		c.stats.Dropped += uint64(i)
+		if i == len(sets) {
+			delete(c.sets, key)
+		} else {
+			c.sets[key] = sets[i:]
+		}
+	}
+}
+
+// dropOldest drops the oldest buffered set. It must be called with c.mut
+// held and the cache not empty.
+func (c *pendingCache) dropOldest() {
+	for len(c.order) > 0 {
+		ref := c.order[0]
+		c.order = c.order[1:]
+
+		// Sets are added and removed in order per template, so the
+		// oldest set is the first one of its template, unless it has
+		// been removed already.
+		sets := c.sets[ref.key]
+		if len(sets) == 0 || sets[0].id != ref.id {
+			continue
+		}
+		c.removed(sets[0])
+		if len(sets) == 1 {
+			delete(c.sets, ref.key)
+		} else {
+			c.sets[ref.key] = sets[1:]
+		}
+		c.stats.Dropped++
+		return
+	}
+}
+
+// removed accounts for a set being removed from the cache. It must be called
+// with c.mut held.
+func (c *pendingCache) removed(set pendingSet) {
+	c.count--
+	c.size -= len(set.data)
+
+	if len(c.order) > 2*c.count+64 {
+		// Forget the references to sets that were removed
+		order := c.order[:0]
+		for _, ref := range c.order {
+			if c.buffered(ref) {
+				order = append(order, ref)
+			}
+		}
+		c.order = order
+	}
+}
+
+func (c *pendingCache) buffered(ref pendingRef) bool {
+	for _, set := range c.sets[ref.key] {
+		if set.id == ref.id {
+			return true
+		}
+	}
+	return false
+}
+
+func (c *pendingCache) isExpired(set pendingSet, now time.Time) bool {
+	return c.timeout > 0 && now.Sub(set.received) > c.timeout
+}
+
+func (c *pendingCache) recovered() {
+	c.mut.Lock()
+	c.stats.Recovered++
+	c.mut.Unlock()
+}
+
+func (c *pendingCache) dropped() {
+	c.mut.Lock()
+	c.stats.Dropped++
+	c.mut.Unlock()
+}
+
+// PendingStats returns the counters for data sets buffered while waiting for
+// their template.
+func (s *Session) PendingStats() PendingStats {
+	s.pending.mut.Lock()
+	defer s.pending.mut.Unlock()
+	return s.pending.stats
+}
+
+// readPendingDataSets decodes the data sets buffered for the template into
+// the message. The recovered records were not part of the message as sent,
+// so they are not counted towards its sequence number.
+func (s *Session) readPendingDataSets(key templateKey, msg *Message) {
+	if !s.pending.enabled() {
+		return
+	}
+
+	if s.lookupTemplate(key) == nil {
+		// The template was not usable, keep waiting
+		return
+	}
+
+	for _, data := range s.pending.take(key, s.now()) {
+		drecs, orecs := len(msg.DataRecords), len(msg.OptionsDataRecords)
+		err := s.readDataSet(setHeader{SetID: key.templateID}, newSlice(data), msg)
+		if err != nil {
+			if debug {
+				dl.Println("pending data set:", err)
+			}
+			msg.DataRecords = msg.DataRecords[:drecs]
+			msg.OptionsDataRecords = msg.OptionsDataRecords[:orecs]
+			s.pending.dropped()
+			continue
+		}
+		msg.recoveredRecords += len(msg.DataRecords) - drecs + len(msg.OptionsDataRecords) - orecs
+		s.pending.recovered()
+	}
+}
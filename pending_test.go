@@ -0,0 +1,109 @@
+package ipfix_test
+
+import (
+	"encoding/hex"
+	"testing"
+	"time"
+
+	"github.com/calmh/ipfix"
+)
+
+func TestPendingDataSets(t *testing.T) {
+	t1, _ := hex.DecodeString("000a0020000000000000000000000001000200100100000200080004000c0004")
+	d1, _ := hex.DecodeString("000a001c0000000000000000000000010100000c0a0000010a000002")
+
+	p := ipfix.NewSession(ipfix.WithPendingDataSets(2, time.Minute))
+
+	for i := 0; i < 3; i++ {
+		msg, err := p.ParseBuffer(d1)
+		if err != nil {
+			t.Fatal("ParseBuffer failed", err)
+		}
+		if len(msg.DataRecords) != 0 {
+			t.Error("Incorrect number of data records", len(msg.DataRecords))
+		}
+	}
+
+	msg, err := p.ParseBuffer(t1)
+	if err != nil {
+		t.Fatal("ParseBuffer failed", err)
+	}
+	if len(msg.TemplateRecords) != 1 {
+		t.Error("Incorrect number of template records", len(msg.TemplateRecords))
+	}
+	if len(msg.DataRecords) != 2 {
+		t.Error("Incorrect number of recovered data records", len(msg.DataRecords))
+	}
+
+	exp := ipfix.PendingStats{Buffered: 3, Recovered: 2, Dropped: 1}
+	if stats := p.PendingStats(); stats != exp {
+		t.Errorf("Incorrect pending stats %+v != %+v", stats, exp)
+	}
+
+	// Nothing is left to recover on a template refresh
+	msg, err = p.ParseBuffer(t1)
+	if err != nil {
+		t.Fatal("ParseBuffer failed", err)
+	}
+	if len(msg.DataRecords) != 0 {
+		t.Error("Incorrect number of data records", len(msg.DataRecords))
+	}
+}
+
+func TestPendingDataSetsLimit(t *testing.T) {
+	t1, _ := hex.DecodeString("000a0020000000000000000000000001000200100100000200080004000c0004")
+	d1, _ := hex.DecodeString("000a001c0000000000000000000000010100000c0a0000010a000002")
+	t2, _ := hex.DecodeString("000a0024000000000000000000000001000200140101000300080004000c000400040001")
+	d2, _ := hex.DecodeString("000a002000000000000000000000000101010010000102030405060708090a0b")
+
+	// Room for the eight byte set of template 256 and the twelve byte set
+	// of template 257, but not for another set of template 256.
+	p := ipfix.NewSession(ipfix.WithPendingDataSets(10, 0), ipfix.WithPendingDataSetsLimit(20))
+
+	for _, bs := range [][]byte{d1, d2, d1} {
+		if _, err := p.ParseBuffer(bs); err != nil {
+			t.Fatal("ParseBuffer failed", err)
+		}
+	}
+
+	for _, bs := range [][]byte{t1, t2} {
+		msg, err := p.ParseBuffer(bs)
+		if err != nil {
+			t.Fatal("ParseBuffer failed", err)
+		}
+		if len(msg.DataRecords) != 1 {
+			t.Error("Incorrect number of recovered data records", len(msg.DataRecords))
+		}
+	}
+
+	exp := ipfix.PendingStats{Buffered: 3, Recovered: 2, Dropped: 1}
+	if stats := p.PendingStats(); stats != exp {
+		t.Errorf("Incorrect pending stats %+v != %+v", stats, exp)
+	}
+
+	// A set larger than the limit is not buffered
+	p = ipfix.NewSession(ipfix.WithPendingDataSets(10, 0), ipfix.WithPendingDataSetsLimit(4))
+	if _, err := p.ParseBuffer(d1); err != nil {
+		t.Fatal("ParseBuffer failed", err)
+	}
+	exp = ipfix.PendingStats{Dropped: 1}
+	if stats := p.PendingStats(); stats != exp {
+		t.Errorf("Incorrect pending stats %+v != %+v", stats, exp)
+	}
+}
+
+func TestPendingDataSetsDisabled(t *testing.T) {
+	t1, _ := hex.DecodeString("000a0020000000000000000000000001000200100100000200080004000c0004")
+	d1, _ := hex.DecodeString("000a001c0000000000000000000000010100000c0a0000010a000002")
+
+	p := ipfix.NewSession()
+	for _, bs := range [][]byte{d1, t1} {
+		msg, err := p.ParseBuffer(bs)
+		if err != nil {
+			t.Fatal("ParseBuffer failed", err)
+		}
+		if len(msg.DataRecords) != 0 {
+			t.Error("Incorrect number of data records", len(msg.DataRecords))
+		}
+	}
+}
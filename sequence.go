@@ -0,0 +1,145 @@
+package ipfix
+
+import "sync"
+
+// A message whose sequence number is further than this many records behind
+// the expected one is taken as a sign of the exporter restarting, rather than
+// a late or duplicated message.
+const sequenceReorderWindow = 1 << 20
+
+// SequenceStatus describes how the sequence number of a message relates to
+// the previous messages from the same Observation Domain.
+type SequenceStatus int
+
+const (
+	// SequenceUnknown is the status of the first message of a domain, and of
+	// the message following one that contained data sets which could not be
+	// decoded, as the number of records in those is unknown.
+	SequenceUnknown SequenceStatus = iota
+	// SequenceOK means that no records were lost since the previous message.
+	SequenceOK
+	// SequenceGap means that records were lost since the previous message.
+	SequenceGap
+	// SequenceDuplicate means that the message arrived out of order or
+	// duplicated, i.e. it should have been received earlier.
+	SequenceDuplicate
+	// SequenceReset means that the exporter restarted its sequence numbering.
+	SequenceReset
+)
+
+func (s SequenceStatus) String() string {
+	switch s {
+	case SequenceUnknown:
+		return "unknown"
+	case SequenceOK:
+		return "ok"
+	case SequenceGap:
+		return "gap"
+	case SequenceDuplicate:
+		return "duplicate"
+	case SequenceReset:
+		return "reset"
+	default:
+		return "invalid"
+	}
+}
+
+// A SequenceCheck is the result of comparing the sequence number of a message
+// to the expected one.
+type SequenceCheck struct {
+	Status SequenceStatus
+	Lost   uint32 // Number of data records lost before the message, for SequenceGap
+}
+
+// LossStats are the accumulated sequence number checks for one Observation
+// Domain.
+type LossStats struct {
+	Messages    uint64 // Messages checked
+	Records     uint64 // Data records received
+	LostRecords uint64 // Data records lost, according to the sequence numbers
+	Gaps        uint64 // Messages with status SequenceGap
+	Duplicates  uint64 // Messages with status SequenceDuplicate
+	Resets      uint64 // Messages with status SequenceReset
+}
+
+type sequenceState struct {
+	valid bool
+	next  uint32
+	stats LossStats
+}
+
+type sequenceTracker struct {
+	mut     sync.Mutex
+	domains map[uint32]*sequenceState
+}
+
+// check compares the sequence number of the message to the expected one,
+// counting the message's data records as RFC 7011 specifies. If the message
+// contained data sets that could not be decoded the following message can't
+// be checked.
+func (t *sequenceTracker) check(hdr MessageHeader, records int, complete bool) SequenceCheck {
+	t.mut.Lock()
+	defer t.mut.Unlock()
+
+	if t.domains == nil {
+		t.domains = make(map[uint32]*sequenceState)
+	}
+	st, ok := t.domains[hdr.DomainID]
+	if !ok {
+		st = new(sequenceState)
+		t.domains[hdr.DomainID] = st
+	}
+
+	var res SequenceCheck
+	diff := int32(hdr.SequenceNumber - st.next)
+	switch {
+	case !st.valid:
+		res.Status = SequenceUnknown
+	case diff == 0:
+		res.Status = SequenceOK
+	case diff > 0:
+		res.Status = SequenceGap
+		res.Lost = uint32(diff)
+		st.stats.Gaps++
+		st.stats.LostRecords += uint64(diff)
+	case hdr.SequenceNumber == 0 || -diff > sequenceReorderWindow:
+		res.Status = SequenceReset
+		st.stats.Resets++
+	default:
+		res.Status = SequenceDuplicate
+		st.stats.Duplicates++
+	}
+
+	if debug && res.Status > SequenceOK {
+		dl.Printf("sequence %v for domain %d: got %d, expected %d", res.Status, hdr.DomainID, hdr.SequenceNumber, st.next)
+	}
+
+	st.stats.Messages++
+	st.stats.Records += uint64(records)
+
+	if res.Status != SequenceDuplicate {
+		// A duplicate doesn't change what we expect next
+		st.next = hdr.SequenceNumber + uint32(records)
+		st.valid = complete
+	}
+
+	return res
+}
+
+// stats returns a copy of the loss statistics for all domains.
+func (t *sequenceTracker) stats() map[uint32]LossStats {
+	t.mut.Lock()
+	defer t.mut.Unlock()
+
+	res := make(map[uint32]LossStats, len(t.domains))
+	for id, st := range t.domains {
+		res[id] = st.stats
+	}
+	return res
+}
+
+// LossStats returns the sequence number statistics for each Observation
+// Domain seen by the Session.
+func (s *Session) LossStats() map[uint32]LossStats {
+	return s.sequences.stats()
+}
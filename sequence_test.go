@@ -0,0 +1,52 @@
+package ipfix_test
+
+import (
+	"encoding/hex"
+	"testing"
+
+	"github.com/calmh/ipfix"
+)
+
+func TestSequenceTracking(t *testing.T) {
+	t1, _ := hex.DecodeString("000a0020000000000000000000000001000200100100000200080004000c0004")
+	// One data record each, with sequence numbers 0, 3, 1 and 0
+	d0, _ := hex.DecodeString("000a001c0000000000000000000000010100000c0a0000010a000002")
+	d3, _ := hex.DecodeString("000a001c0000000000000003000000010100000c0a0000010a000002")
+	d1, _ := hex.DecodeString("000a001c0000000000000001000000010100000c0a0000010a000002")
+	// Data set for an unknown template in domain 2
+	u, _ := hex.DecodeString("000a00180000000000000000000000020100000800500051")
+
+	cases := []struct {
+		bs     []byte
+		status ipfix.SequenceStatus
+		lost   uint32
+	}{
+		{t1, ipfix.SequenceUnknown, 0},
+		{d0, ipfix.SequenceOK, 0},
+		{d3, ipfix.SequenceGap, 2},
+		{d1, ipfix.SequenceDuplicate, 0},
+		{d0, ipfix.SequenceReset, 0},
+		{u, ipfix.SequenceUnknown, 0},
+		{u, ipfix.SequenceUnknown, 0},
+	}
+
+	p := ipfix.NewSession()
+	for i, tc := range cases {
+		msg, err := p.ParseBuffer(tc.bs)
+		if err != nil {
+			t.Fatal("ParseBuffer failed", err)
+		}
+		if msg.Sequence.Status != tc.status || msg.Sequence.Lost != tc.lost {
+			t.Errorf("%d: incorrect sequence check %+v, expected %v/%d", i, msg.Sequence, tc.status, tc.lost)
+		}
+	}
+
+	stats := p.LossStats()
+	exp := ipfix.LossStats{Messages: 5, Records: 4, LostRecords: 2, Gaps: 1, Duplicates: 1, Resets: 1}
+	if stats[1] != exp {
+		t.Errorf("Incorrect loss stats %+v != %+v", stats[1], exp)
+	}
+	if stats[2].Messages != 2 || stats[2].LostRecords != 0 {
+		t.Errorf("Incorrect loss stats for domain 2: %+v", stats[2])
+	}
+}
@@ -0,0 +1,180 @@
+package ipfix
+
+import (
+	"crypto/sha1"
+	"encoding/json"
+	"fmt"
+	"io"
+	"sort"
+	"time"
+)
+
+// The version of the format written by SaveTemplates. LoadTemplates accepts
+// this version and converts older ones. Version 2 added firstSeen.
+const templateStateVersion = 2
+
+type templateState struct {
+	Version   int             `json:"version"`
+	Aliasing  bool            `json:"aliasing"`
+	NextID    uint16          `json:"nextID,omitempty"`
+	Templates []savedTemplate `json:"templates"`
+	Virtual   []savedTemplate `json:"virtual,omitempty"`
+}
+
+type savedTemplate struct {
+	DomainID        uint32                   `json:"domainID"`
+	TemplateID      uint16                   `json:"templateID"`
+	ScopeFieldCount uint16                   `json:"scopeFieldCount,omitempty"`
+	Alias           uint16                   `json:"alias,omitempty"`
+	FirstSeen       time.Time                `json:"firstSeen"`
+	LastSeen        time.Time                `json:"lastSeen"`
+	FieldSpecifiers []TemplateFieldSpecifier `json:"fieldSpecifiers"`
+}
+
+// SaveTemplates writes the templates and options templates currently known
+// to the Session to w, in a versioned format understood by LoadTemplates.
+// With ID aliasing the virtual template IDs are saved as well, so that they
+// remain the same after a restart.
+func (s *Session) SaveTemplates(w io.Writer) error {
+	state := templateState{
+		Version:  templateStateVersion,
+		Aliasing: s.withIDAliasing,
+	}
+
+	s.mut.RLock()
+	state.NextID = s.nextID
+	for key, tpl := range s.templates {
+		state.Templates = append(state.Templates, saveTemplate(key, tpl))
+	}
+	for id, tpl := range s.virtual {
+		state.Virtual = append(state.Virtual, saveTemplate(templateKey{templateID: id}, tpl))
+	}
+	s.mut.RUnlock()
+
+	// Stable output makes the files diffable
+	sortSavedTemplates(state.Templates)
+	sortSavedTemplates(state.Virtual)
+
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(state)
+}
+
+// LoadTemplates replaces the templates of the Session with those written by
+// SaveTemplates. The Session must use the same ID aliasing setting as the
+// one that saved the templates. Loaded templates expire as usual, based on
+// when they were last seen by the saving Session.
+func (s *Session) LoadTemplates(r io.Reader) error {
+	var state templateState
+	if err := json.NewDecoder(r).Decode(&state); err != nil {
+		return err
+	}
+	switch state.Version {
+	case 1:
+		// First seen times weren't tracked
+		for i := range state.Templates {
+			state.Templates[i].FirstSeen = state.Templates[i].LastSeen
+		}
+		for i := range state.Virtual {
+			state.Virtual[i].FirstSeen = state.Virtual[i].LastSeen
+		}
+	case templateStateVersion:
+	default:
+		return fmt.Errorf("unsupported template state version %d", state.Version)
+	}
+	if state.Aliasing != s.withIDAliasing {
+		return fmt.Errorf("template state aliasing %v does not match session", state.Aliasing)
+	}
+
+	templates := make(map[templateKey]*template, len(state.Templates))
+	var virtual map[uint16]*template
+	var signatures map[[sha1.Size]byte]uint16
+	var aliasRefs map[uint16]int
+	var freeAliases []uint16
+
+	if s.withIDAliasing {
+		virtual = make(map[uint16]*template, len(state.Virtual))
+		signatures = make(map[[sha1.Size]byte]uint16, len(state.Virtual))
+		aliasRefs = make(map[uint16]int, len(state.Virtual))
+		for _, st := range state.Virtual {
+			tpl := st.template()
+			if !tpl.valid() || st.TemplateID < 256 || st.TemplateID >= state.NextID {
+				return fmt.Errorf("invalid virtual template %d", st.TemplateID)
+			}
+			tpl.alias = st.TemplateID
+			virtual[st.TemplateID] = tpl
+			signatures[templateSignature(tpl.specifiers, tpl.scopeFields)] = st.TemplateID
+		}
+	}
+
+	for _, st := range state.Templates {
+		tpl := st.template()
+		if !tpl.valid() {
+			return fmt.Errorf("invalid template %d/%d", st.DomainID, st.TemplateID)
+		}
+		if s.withIDAliasing {
+			if _, ok := virtual[st.Alias]; !ok {
+				return fmt.Errorf("template %d/%d has unknown alias %d", st.DomainID, st.TemplateID, st.Alias)
+			}
+			tpl.alias = st.Alias
+			aliasRefs[st.Alias]++
+		}
+		templates[templateKey{st.DomainID, st.TemplateID}] = tpl
+	}
+
+	// The order in which the unreferenced virtual templates were released
+	// isn't saved, so they are reused in ID order.
+	for _, st := range state.Virtual {
+		if aliasRefs[st.TemplateID] == 0 {
+			freeAliases = append(freeAliases, st.TemplateID)
+		}
+	}
+
+	s.mut.Lock()
+	s.templates = templates
+	if s.withIDAliasing {
+		s.virtual = virtual
+		s.signatures = signatures
+		s.aliasRefs = aliasRefs
+		s.freeAliases = freeAliases
+		s.nextID = state.NextID
+	}
+	s.mut.Unlock()
+
+	return nil
+}
+
+func saveTemplate(key templateKey, tpl *template) savedTemplate {
+	return savedTemplate{
+		DomainID:        key.domainID,
+		TemplateID:      key.templateID,
+		ScopeFieldCount: tpl.scopeFields,
+		Alias:           tpl.alias,
+		FirstSeen:       tpl.firstSeen,
+		LastSeen:        tpl.lastSeen,
+		FieldSpecifiers: tpl.specifiers,
+	}
+}
+
+func (st savedTemplate) template() *template {
+	return &template{
+		specifiers:  st.FieldSpecifiers,
+		scopeFields: st.ScopeFieldCount,
+		minRecord:   calcMinRecLen(st.FieldSpecifiers),
+		firstSeen:   st.FirstSeen,
+		lastSeen:    st.LastSeen,
+	}
+}
+
+func (tpl *template) valid() bool {
+	return tpl.minRecord > 0 && int(tpl.scopeFields) <= len(tpl.specifiers)
+}
+
+func sortSavedTemplates(ts []savedTemplate) {
+	sort.Slice(ts, func(a, b int) bool {
+		if ts[a].DomainID != ts[b].DomainID {
+			return ts[a].DomainID < ts[b].DomainID
+		}
+		return ts[a].TemplateID < ts[b].TemplateID
+	})
+}
@@ -0,0 +1,108 @@
+package ipfix_test
+
+import (
+	"bytes"
+	"encoding/hex"
+	"strings"
+	"testing"
+
+	"github.com/calmh/ipfix"
+)
+
+func TestSaveLoadTemplates(t *testing.T) {
+	testSaveLoadTemplates(false, t)
+}
+
+func TestSaveLoadTemplatesWithAliasing(t *testing.T) {
+	testSaveLoadTemplates(true, t)
+}
+
+func testSaveLoadTemplates(withAliasing bool, t *testing.T) {
+	// Templates 256 and 257 plus options template 258 in domain 1,
+	// template 256 in domain 2
+	t1, _ := hex.DecodeString("000a003600000000000000000000000100020014010000010008000401010001000c0004000300120102000200010095000400220004")
+	t2, _ := hex.DecodeString("000a001c0000000000000000000000020002000c0100000100080004")
+	// A new template 300 in domain 1
+	t3, _ := hex.DecodeString("000a002000000000000000000000000100020010012c000200070002000b0002")
+	// Options data for template 258 in domain 1
+	d1, _ := hex.DecodeString("000a001c0000000000000000000000010102000c0000000100000064")
+
+	p0 := ipfix.NewSession(ipfix.WithIDAliasing(withAliasing))
+	for _, bs := range [][]byte{t1, t2} {
+		if _, err := p0.ParseBuffer(bs); err != nil {
+			t.Fatal("ParseBuffer failed", err)
+		}
+	}
+
+	var buf bytes.Buffer
+	if err := p0.SaveTemplates(&buf); err != nil {
+		t.Fatal("SaveTemplates failed", err)
+	}
+
+	p1 := ipfix.NewSession(ipfix.WithIDAliasing(withAliasing))
+	if err := p1.LoadTemplates(bytes.NewReader(buf.Bytes())); err != nil {
+		t.Fatal("LoadTemplates failed", err)
+	}
+
+	msg0, err := p0.ParseBuffer(d1)
+	if err != nil {
+		t.Fatal("ParseBuffer failed", err)
+	}
+	msg1, err := p1.ParseBuffer(d1)
+	if err != nil {
+		t.Fatal("ParseBuffer failed", err)
+	}
+	if len(msg1.OptionsDataRecords) != 1 {
+		t.Fatal("Incorrect number of options data records", len(msg1.OptionsDataRecords))
+	}
+	if id0, id1 := msg0.OptionsDataRecords[0].TemplateID, msg1.OptionsDataRecords[0].TemplateID; id0 != id1 {
+		t.Errorf("Template ID %d after load != %d before", id1, id0)
+	}
+
+	// New templates get the same IDs in both sessions
+	msg0, err = p0.ParseBuffer(t3)
+	if err != nil {
+		t.Fatal("ParseBuffer failed", err)
+	}
+	msg1, err = p1.ParseBuffer(t3)
+	if err != nil {
+		t.Fatal("ParseBuffer failed", err)
+	}
+	if id0, id1 := msg0.TemplateRecords[0].TemplateID, msg1.TemplateRecords[0].TemplateID; id0 != id1 {
+		t.Errorf("Template ID %d after load != %d before", id1, id0)
+	}
+}
+
+func TestLoadTemplatesAliasingMismatch(t *testing.T) {
+	var buf bytes.Buffer
+	if err := ipfix.NewSession().SaveTemplates(&buf); err != nil {
+		t.Fatal("SaveTemplates failed", err)
+	}
+
+	p := ipfix.NewSession(ipfix.WithIDAliasing(true))
+	if err := p.LoadTemplates(&buf); err == nil {
+		t.Error("Unexpected nil error")
+	}
+}
+
+func TestLoadTemplatesVersion1(t *testing.T) {
+	// Version 1 did not save first seen times
+	v1 := `{"version": 1, "aliasing": false, "templates": [{"domainID": 1, "templateID": 256, "lastSeen": "2026-10-18T12:00:00Z", "fieldSpecifiers": [{"EnterpriseID": 0, "FieldID": 8, "Length": 4}]}]}`
+
+	p := ipfix.NewSession()
+	if err := p.LoadTemplates(strings.NewReader(v1)); err != nil {
+		t.Fatal("LoadTemplates failed", err)
+	}
+
+	info, ok := p.Template(1, 256)
+	if !ok {
+		t.Fatal("Template not loaded")
+	}
+	if !info.FirstSeen.Equal(info.LastSeen) || info.LastSeen.IsZero() {
+		t.Errorf("Incorrect first seen %v, last seen %v", info.FirstSeen, info.LastSeen)
+	}
+
+	if err := p.LoadTemplates(strings.NewReader(`{"version": 3}`)); err == nil {
+		t.Error("Unexpected nil error")
+	}
+}
@@ -0,0 +1,143 @@
+package ipfix
+
+import (
+	"errors"
+	"io"
+	"sync/atomic"
+)
+
+// Stats are the counters of a Session, as returned by Session.Stats.
+type Stats struct {
+	Messages               uint64 // Messages with a valid header, including those that failed to parse
+	Bytes                  uint64 // Bytes in the messages parsed
+	TemplateSets           uint64
+	OptionsTemplateSets    uint64
+	DataSets               uint64
+	TemplateRecords        uint64
+	OptionsTemplateRecords uint64
+	DataRecords            uint64
+	OptionsDataRecords     uint64
+	UnknownTemplateSets    uint64 // Data sets dropped or buffered for lack of a template
+	PaddingBytes           uint64 // Padding skipped at the end of sets
+	UnknownFields          uint64 // Fields interpreted without a dictionary entry
+	Errors                 ErrorStats
+}
+
+// ErrorStats count the parse errors of a Session by kind. Errors for sets
+// skipped with WithLenientParsing are included.
+type ErrorStats struct {
+	Read        uint64 // ErrRead
+	Protocol    uint64 // ErrProtocol
+	Version     uint64 // ErrVersion
+	Truncated   uint64 // io.ErrUnexpectedEOF
+	TemplateIDs uint64 // ErrTemplateIDsExhausted
+	Other       uint64
+}
+
+// sessionStats are the counters behind Stats, updated atomically. They must
+// be 64 bit aligned.
+type sessionStats struct {
+	messages               uint64
+	bytes                  uint64
+	templateSets           uint64
+	optionsTemplateSets    uint64
+	dataSets               uint64
+	templateRecords        uint64
+	optionsTemplateRecords uint64
+	dataRecords            uint64
+	optionsDataRecords     uint64
+	unknownTemplateSets    uint64
+	paddingBytes           uint64
+	unknownFields          uint64
+	errRead                uint64
+	errProtocol            uint64
+	errVersion             uint64
+	errTruncated           uint64
+	errTemplateIDs         uint64
+	errOther               uint64
+}
+
+// Stats returns a snapshot of the Session's counters. It is cheap and may be
+// called concurrently with parsing.
+func (s *Session) Stats() Stats {
+	c := &s.stats
+	return Stats{
+		Messages:               atomic.LoadUint64(&c.messages),
+		Bytes:                  atomic.LoadUint64(&c.bytes),
+		TemplateSets:           atomic.LoadUint64(&c.templateSets),
+		OptionsTemplateSets:    atomic.LoadUint64(&c.optionsTemplateSets),
+		DataSets:               atomic.LoadUint64(&c.dataSets),
+		TemplateRecords:        atomic.LoadUint64(&c.templateRecords),
+		OptionsTemplateRecords: atomic.LoadUint64(&c.optionsTemplateRecords),
+		DataRecords:            atomic.LoadUint64(&c.dataRecords),
+		OptionsDataRecords:     atomic.LoadUint64(&c.optionsDataRecords),
+		UnknownTemplateSets:    atomic.LoadUint64(&c.unknownTemplateSets),
+		PaddingBytes:           atomic.LoadUint64(&c.paddingBytes),
+		UnknownFields:          atomic.LoadUint64(&c.unknownFields),
+		Errors: ErrorStats{
+			Read:        atomic.LoadUint64(&c.errRead),
+			Protocol:    atomic.LoadUint64(&c.errProtocol),
+			Version:     atomic.LoadUint64(&c.errVersion),
+			Truncated:   atomic.LoadUint64(&c.errTruncated),
+			TemplateIDs: atomic.LoadUint64(&c.errTemplateIDs),
+			Other:       atomic.LoadUint64(&c.errOther),
+		},
+	}
+}
+
+func (c *sessionStats) countMessage(hdr MessageHeader) {
+	atomic.AddUint64(&c.messages, 1)
+	atomic.AddUint64(&c.bytes, uint64(hdr.Length))
+}
+
+func (c *sessionStats) countSet(setID uint16) {
+	switch {
+	case setID == 2:
+		atomic.AddUint64(&c.templateSets, 1)
+	case setID == 3:
+		atomic.AddUint64(&c.optionsTemplateSets, 1)
+	case setID >= 256:
+		atomic.AddUint64(&c.dataSets, 1)
+	}
+}
+
+// countRecords counts the records of a parsed message.
+func (c *sessionStats) countRecords(msg *Message) {
+	if n := len(msg.TemplateRecords); n > 0 {
+		atomic.AddUint64(&c.templateRecords, uint64(n))
+	}
+	if n := len(msg.OptionsTemplateRecords); n > 0 {
+		atomic.AddUint64(&c.optionsTemplateRecords, uint64(n))
+	}
+	if n := len(msg.DataRecords); n > 0 {
+		atomic.AddUint64(&c.dataRecords, uint64(n))
+	}
+	if n := len(msg.OptionsDataRecords); n > 0 {
+		atomic.AddUint64(&c.optionsDataRecords, uint64(n))
+	}
+}
+
+func (c *sessionStats) countRecord(tpl *template) {
+	if tpl.scopeFields > 0 {
+		atomic.AddUint64(&c.optionsDataRecords, 1)
+	} else {
+		atomic.AddUint64(&c.dataRecords, 1)
+	}
+}
+
+func (c *sessionStats) countError(err error) {
+	switch {
+	case errors.Is(err, ErrRead):
+		atomic.AddUint64(&c.errRead, 1)
+	case errors.Is(err, ErrProtocol):
+		atomic.AddUint64(&c.errProtocol, 1)
+	case errors.Is(err, ErrVersion):
+		atomic.AddUint64(&c.errVersion, 1)
+	case errors.Is(err, io.ErrUnexpectedEOF):
+		atomic.AddUint64(&c.errTruncated, 1)
+	case errors.Is(err, ErrTemplateIDsExhausted):
+		atomic.AddUint64(&c.errTemplateIDs, 1)
+	default:
+		atomic.AddUint64(&c.errOther, 1)
+	}
+}
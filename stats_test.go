@@ -0,0 +1,58 @@
+package ipfix_test
+
+import (
+	"encoding/hex"
+	"testing"
+
+	"github.com/calmh/ipfix"
+)
+
+func TestStats(t *testing.T) {
+	// Template 256 with a sourceIPv4Address and the unknown field 30000, a
+	// data set with two records and two bytes of padding, and a data set for
+	// the unknown template 300.
+	packet, _ := hex.DecodeString("000a003a00000000000000000000000100020010010000020008000475300002010000120a00000100010a00000200020000012c000800000000")
+
+	p := ipfix.NewSession()
+	msg, err := p.ParseBuffer(packet)
+	if err != nil {
+		t.Fatal("ParseBuffer failed", err)
+	}
+	i := ipfix.NewInterpreter(p)
+	for _, rec := range msg.DataRecords {
+		i.Interpret(rec)
+	}
+
+	bad := append([]byte{}, packet...)
+	bad[1] = 9
+	if _, err := p.ParseBuffer(bad); err != ipfix.ErrVersion {
+		t.Fatalf("Received %v instead of ipfix.ErrVersion", err)
+	}
+
+	exp := ipfix.Stats{
+		Messages:            1,
+		Bytes:               uint64(len(packet)),
+		TemplateSets:        1,
+		DataSets:            2,
+		TemplateRecords:     1,
+		DataRecords:         2,
+		UnknownTemplateSets: 1,
+		PaddingBytes:        2,
+		UnknownFields:       2,
+		Errors:              ipfix.ErrorStats{Version: 1},
+	}
+	if stats := p.Stats(); stats != exp {
+		t.Errorf("Incorrect stats\n%+v, expected\n%+v", stats, exp)
+	}
+
+	// The cursor counts the same way
+	p = ipfix.NewSession()
+	c := p.Records(packet)
+	for c.Next() {
+	}
+	exp.UnknownFields = 0
+	exp.Errors.Version = 0
+	if stats := p.Stats(); stats != exp {
+		t.Errorf("Incorrect cursor stats\n%+v, expected\n%+v", stats, exp)
+	}
+}
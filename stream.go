@@ -0,0 +1,222 @@
+package ipfix
+
+import (
+	"bufio"
+	"context"
+	"io"
+	"time"
+)
+
+// A StreamReader reads IPFIX messages from a stream transport such as TCP or
+// a file. Unlike Read it can be cancelled, and it can optionally recover from
+// corrupted input by searching for the next plausible message.
+type StreamReader struct {
+	src    io.Reader
+	br     *bufio.Reader
+	buf    []byte
+	resync bool
+
+	lost    bool            // searching for the next message after corruption
+	domains map[uint32]bool // domains seen in good messages
+	skipped int64
+}
+
+// A StreamOption is an option for NewStreamReader.
+type StreamOption func(*StreamReader)
+
+// WithResync enables or disables resynchronization. When enabled, input that
+// doesn't look like the start of a message is skipped until something that
+// does is found: version 10, a length that is consistent with the set
+// headers, and, if messages were read before, an Observation Domain seen
+// before on the stream. The default is disabled, so that corrupted input
+// results in ErrVersion or io.ErrUnexpectedEOF and the stream is unusable
+// from there on.
+func WithResync(v bool) StreamOption {
+	return func(r *StreamReader) {
+		r.resync = v
+	}
+}
+
+// NewStreamReader returns a StreamReader reading from r.
+func NewStreamReader(r io.Reader, opts ...StreamOption) *StreamReader {
+	sr := &StreamReader{
+		src:     r,
+		br:      bufio.NewReaderSize(r, 65536),
+		domains: make(map[uint32]bool),
+	}
+	for _, opt := range opts {
+		opt(sr)
+	}
+	return sr
+}
+
+// The read deadline is set to this to interrupt a blocked read.
+var aLongTimeAgo = time.Unix(1, 0)
+
+type deadliner interface {
+	SetReadDeadline(time.Time) error
+}
+
+// Read reads and returns the next IPFIX message and its parsed header. The
+// returned slice contains the message header and is valid until the next
+// call to Read. If the underlying reader supports read deadlines, as
+// net.Conn and os.File do, the deadline and cancellation of ctx interrupt a
+// blocked read and ctx.Err() is returned. Otherwise ctx is only checked
+// before reading. An interrupted read may be retried without losing data.
+func (r *StreamReader) Read(ctx context.Context) ([]byte, MessageHeader, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, MessageHeader{}, err
+	}
+
+	if d, ok := r.src.(deadliner); ok {
+		// The zero deadline clears any deadline set for a previous read
+		deadline, _ := ctx.Deadline()
+		if err := d.SetReadDeadline(deadline); err == nil && ctx.Done() != nil {
+			stop := make(chan struct{})
+			done := make(chan struct{})
+			go func() {
+				defer close(done)
+				select {
+				case <-ctx.Done():
+					d.SetReadDeadline(aLongTimeAgo)
+				case <-stop:
+				}
+			}()
+			defer func() {
+				close(stop)
+				<-done
+			}()
+		}
+	}
+
+	bs, hdr, err := r.next()
+	if err != nil {
+		if deadline, ok := ctx.Deadline(); ok && !time.Now().Before(deadline) {
+			// The read deadline may pass just before the context's
+			<-ctx.Done()
+		}
+		if ctx.Err() != nil {
+			err = ctx.Err()
+		}
+	}
+	return bs, hdr, err
+}
+
+// Skipped returns the number of bytes skipped while resynchronizing.
+func (r *StreamReader) Skipped() int64 {
+	return r.skipped
+}
+
+func (r *StreamReader) next() ([]byte, MessageHeader, error) {
+	for {
+		bs, err := r.br.Peek(msgHeaderLength)
+		if err != nil {
+			if err == io.EOF && len(bs) > 0 {
+				err = io.ErrUnexpectedEOF
+			}
+			return nil, MessageHeader{}, err
+		}
+
+		var hdr MessageHeader
+		hdr.unmarshal(newSlice(bs))
+
+		var herr error
+		switch {
+		case hdr.Version != 10:
+			herr = ErrVersion
+		case hdr.Length < msgHeaderLength:
+			// Message can't be shorter than its header
+			herr = io.ErrUnexpectedEOF
+		case r.lost && len(r.domains) > 0 && !r.domains[hdr.DomainID]:
+			herr = ErrVersion
+		}
+		if herr != nil {
+			if !r.resync {
+				return nil, hdr, herr
+			}
+			r.skip()
+			continue
+		}
+
+		if r.resync {
+			// Check what is already buffered before waiting for the rest
+			// of the message, which may not exist if the header is garbage.
+			n := r.br.Buffered()
+			if n > int(hdr.Length) {
+				n = int(hdr.Length)
+			}
+			bs, _ = r.br.Peek(n)
+			if !plausibleSets(bs[msgHeaderLength:], n < int(hdr.Length)) {
+				r.skip()
+				continue
+			}
+		}
+
+		bs, err = r.br.Peek(int(hdr.Length))
+		if err != nil {
+			if err == io.EOF {
+				if r.resync {
+					// The stream ends before the claimed length, so this
+					// wasn't a message header.
+					r.skip()
+					continue
+				}
+				err = io.ErrUnexpectedEOF
+			}
+			return nil, hdr, err
+		}
+
+		if r.resync && !plausibleSets(bs[msgHeaderLength:], false) {
+			r.skip()
+			continue
+		}
+
+		r.buf = append(r.buf[:0], bs...)
+		r.br.Discard(len(bs))
+
+		if r.lost {
+			if debug {
+				dl.Printf("resynchronized after %d skipped bytes", r.skipped)
+			}
+			r.lost = false
+		}
+		r.domains[hdr.DomainID] = true
+
+		return r.buf, hdr, nil
+	}
+}
+
+// skip discards one byte, to look for a message header at the next offset.
+func (r *StreamReader) skip() {
+	if !r.lost && debug {
+		dl.Println("lost synchronization, searching for next message")
+	}
+	r.lost = true
+	r.br.Discard(1)
+	r.skipped++
+}
+
+// plausibleSets returns true if the set headers in the message body add up to
+// exactly the body length. If partial is set, bs is only the start of the
+// body and only the set headers within it are checked.
+func plausibleSets(bs []byte, partial bool) bool {
+	sl := newSlice(bs)
+	for sl.Len() > 0 {
+		if partial && sl.Len() < setHeaderLength {
+			return true
+		}
+		var setHdr setHeader
+		setHdr.unmarshal(sl)
+		if setHdr.Length < setHeaderLength || setHdr.SetID < 2 || setHdr.SetID > 3 && setHdr.SetID < 256 {
+			return false
+		}
+		if partial && sl.Len() < int(setHdr.Length)-setHeaderLength {
+			return true
+		}
+		sl.Cut(int(setHdr.Length) - setHeaderLength)
+		if sl.Error() != nil {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,178 @@
+package ipfix_test
+
+import (
+	"bytes"
+	"context"
+	"encoding/hex"
+	"io"
+	"net"
+	"testing"
+	"testing/iotest"
+	"time"
+
+	"github.com/calmh/ipfix"
+)
+
+func TestStreamReader(t *testing.T) {
+	t1, _ := hex.DecodeString("000a0020000000000000000000000001000200100100000200080004000c0004")
+	d1, _ := hex.DecodeString("000a001c0000000000000000000000010100000c0a0000010a000002")
+
+	r := ipfix.NewStreamReader(bytes.NewReader(append(append([]byte{}, t1...), d1...)))
+	ctx := context.Background()
+
+	for _, exp := range [][]byte{t1, d1} {
+		bs, hdr, err := r.Read(ctx)
+		if err != nil {
+			t.Fatal("Read failed", err)
+		}
+		if !bytes.Equal(bs, exp) || int(hdr.Length) != len(exp) {
+			t.Errorf("Incorrect message %x", bs)
+		}
+	}
+	if _, _, err := r.Read(ctx); err != io.EOF {
+		t.Errorf("Received %v instead of io.EOF error", err)
+	}
+}
+
+func TestStreamReaderResync(t *testing.T) {
+	t1, _ := hex.DecodeString("000a0020000000000000000000000001000200100100000200080004000c0004")
+	d1, _ := hex.DecodeString("000a001c0000000000000000000000010100000c0a0000010a000002")
+
+	// Garbage, including something that looks like a header for another
+	// domain, between the messages.
+	garbage, _ := hex.DecodeString("0102000a001c000000000000000000000002")
+	var stream []byte
+	stream = append(stream, t1...)
+	stream = append(stream, garbage...)
+	stream = append(stream, d1...)
+
+	r := ipfix.NewStreamReader(bytes.NewReader(stream))
+	if _, _, err := r.Read(context.Background()); err != nil {
+		t.Fatal("Read failed", err)
+	}
+	if _, _, err := r.Read(context.Background()); err != ipfix.ErrVersion {
+		t.Fatalf("Received %v instead of ipfix.ErrVersion error", err)
+	}
+
+	r = ipfix.NewStreamReader(bytes.NewReader(stream), ipfix.WithResync(true))
+	for _, exp := range [][]byte{t1, d1} {
+		bs, _, err := r.Read(context.Background())
+		if err != nil {
+			t.Fatal("Read failed", err)
+		}
+		if !bytes.Equal(bs, exp) {
+			t.Errorf("Incorrect message %x", bs)
+		}
+	}
+	if r.Skipped() != int64(len(garbage)) {
+		t.Error("Incorrect number of skipped bytes", r.Skipped())
+	}
+}
+
+func TestStreamReaderResyncLength(t *testing.T) {
+	t1, _ := hex.DecodeString("000a0020000000000000000000000001000200100100000200080004000c0004")
+	d1, _ := hex.DecodeString("000a001c0000000000000000000000010100000c0a0000010a000002")
+
+	// Garbage that looks like a header claiming a length past the end of
+	// the stream.
+	garbage, _ := hex.DecodeString("000aff00")
+	var stream []byte
+	stream = append(stream, t1...)
+	stream = append(stream, garbage...)
+	stream = append(stream, d1...)
+	stream = append(stream, d1...)
+
+	r := ipfix.NewStreamReader(bytes.NewReader(stream), ipfix.WithResync(true))
+	for _, exp := range [][]byte{t1, d1, d1} {
+		bs, _, err := r.Read(context.Background())
+		if err != nil {
+			t.Fatal("Read failed", err)
+		}
+		if !bytes.Equal(bs, exp) {
+			t.Errorf("Incorrect message %x", bs)
+		}
+	}
+	if r.Skipped() != int64(len(garbage)) {
+		t.Error("Incorrect number of skipped bytes", r.Skipped())
+	}
+
+	// A plausible header and set header at the end of the stream
+	garbage, _ = hex.DecodeString("000a01000000000000000000000000010002" + "00f00000")
+	stream = append(append([]byte{}, d1...), garbage...)
+
+	r = ipfix.NewStreamReader(bytes.NewReader(stream), ipfix.WithResync(true))
+	if _, _, err := r.Read(context.Background()); err != nil {
+		t.Fatal("Read failed", err)
+	}
+	if _, _, err := r.Read(context.Background()); err != io.ErrUnexpectedEOF {
+		t.Errorf("Received %v instead of io.ErrUnexpectedEOF error", err)
+	}
+	if r.Skipped() != int64(len(garbage)-15) {
+		t.Error("Incorrect number of skipped bytes", r.Skipped())
+	}
+}
+
+func TestStreamReaderResyncShortReads(t *testing.T) {
+	t1, _ := hex.DecodeString("000a0020000000000000000000000001000200100100000200080004000c0004")
+	d1, _ := hex.DecodeString("000a001c0000000000000000000000010100000c0a0000010a000002")
+
+	// A header for a known domain claiming 40 bytes, followed by a junk set
+	// header, read one byte at a time so that the sets can't be checked
+	// before the whole message has arrived.
+	garbage, _ := hex.DecodeString("000a002800000000000000000000000100000000")
+	var stream []byte
+	stream = append(stream, t1...)
+	stream = append(stream, garbage...)
+	stream = append(stream, d1...)
+	stream = append(stream, d1...)
+
+	r := ipfix.NewStreamReader(iotest.OneByteReader(bytes.NewReader(stream)), ipfix.WithResync(true))
+	for _, exp := range [][]byte{t1, d1, d1} {
+		bs, _, err := r.Read(context.Background())
+		if err != nil {
+			t.Fatal("Read failed", err)
+		}
+		if !bytes.Equal(bs, exp) {
+			t.Errorf("Incorrect message %x", bs)
+		}
+	}
+	if r.Skipped() != int64(len(garbage)) {
+		t.Error("Incorrect number of skipped bytes", r.Skipped())
+	}
+}
+
+func TestStreamReaderCancel(t *testing.T) {
+	t1, _ := hex.DecodeString("000a0020000000000000000000000001000200100100000200080004000c0004")
+
+	client, server := net.Pipe()
+	defer client.Close()
+	defer server.Close()
+
+	r := ipfix.NewStreamReader(server)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		// Half a message, then nothing
+		client.Write(t1[:10])
+		cancel()
+	}()
+	if _, _, err := r.Read(ctx); err != context.Canceled {
+		t.Fatalf("Received %v instead of context.Canceled", err)
+	}
+
+	ctx, cancel = context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if _, _, err := r.Read(ctx); err != context.DeadlineExceeded {
+		t.Fatalf("Received %v instead of context.DeadlineExceeded", err)
+	}
+
+	// The interrupted message is still read in full
+	go client.Write(t1[10:])
+	bs, _, err := r.Read(context.Background())
+	if err != nil {
+		t.Fatal("Read failed", err)
+	}
+	if !bytes.Equal(bs, t1) {
+		t.Errorf("Incorrect message %x", bs)
+	}
+}
@@ -0,0 +1,420 @@
+package ipfix
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"encoding/binary"
+	"sort"
+	"sync/atomic"
+	"time"
+)
+
+// How often to scan for templates and pending data sets that have timed out.
+const expiryInterval = time.Second
+
+// Template IDs are only unique within an Observation Domain, so templates are
+// stored and looked up by the combination of both.
+type templateKey struct {
+	domainID   uint32
+	templateID uint16
+}
+
+// A template is the Session's view of a template or options template. Once
+// stored in the Session a template is never modified, only replaced.
+type template struct {
+	specifiers  []TemplateFieldSpecifier
+	scopeFields uint16 // zero for templates, nonzero for options templates
+	minRecord   uint16
+	alias       uint16 // the virtual template ID, when ID aliasing is enabled
+	firstSeen   time.Time
+	lastSeen    time.Time
+}
+
+func (s *Session) registerTemplateRecord(domainID uint32, tr *TemplateRecord) error {
+	tid, err := s.registerTemplate(templateKey{domainID, tr.TemplateID}, tr.FieldSpecifiers, 0)
+	if err != nil {
+		return err
+	}
+	tr.TemplateID = tid
+	return nil
+}
+
+func (s *Session) registerOptionsTemplateRecord(domainID uint32, tr *OptionsTemplateRecord) error {
+	// The data records carry the scope fields first, followed by the option
+	// fields, so that is how the template is stored.
+	tpl := make([]TemplateFieldSpecifier, 0, len(tr.ScopeFieldSpecifiers)+len(tr.FieldSpecifiers))
+	tpl = append(tpl, tr.ScopeFieldSpecifiers...)
+	tpl = append(tpl, tr.FieldSpecifiers...)
+	tid, err := s.registerTemplate(templateKey{domainID, tr.TemplateID}, tpl, tr.ScopeFieldCount)
+	if err != nil {
+		return err
+	}
+	tr.TemplateID = tid
+	return nil
+}
+
+// registerTemplate stores the template, replacing any previous definition,
+// and returns the template ID the Session's records will carry for it. An
+// empty template, or one that can't be aliased, removes the previous
+// definition.
+func (s *Session) registerTemplate(key templateKey, tpl []TemplateFieldSpecifier, scopeFields uint16) (uint16, error) {
+	minLen := calcMinRecLen(tpl)
+	now := s.now()
+
+	var ntpl *template
+	var err error
+	s.mut.Lock()
+	old := s.templates[key]
+	if minLen > 0 {
+		ntpl = &template{
+			specifiers:  tpl,
+			scopeFields: scopeFields,
+			minRecord:   minLen,
+			firstSeen:   now,
+			lastSeen:    now,
+		}
+	}
+	if s.withIDAliasing {
+		// A refresh keeps the reference taken by the old definition
+		refresh := false
+		if old != nil && ntpl != nil {
+			ntpl.alias = old.alias
+			refresh = old.sameLayout(ntpl)
+		}
+		if old != nil && !refresh {
+			// Released first, so that a redefinition may reuse the old ID
+			s.releaseAlias(old.alias)
+		}
+		if ntpl != nil && !refresh {
+			if ntpl.alias, err = s.aliasTemplate(ntpl); err != nil {
+				ntpl = nil
+			}
+		}
+	}
+	if ntpl != nil {
+		// Always replace the exporter's template, as it may have been
+		// redefined or just refreshed.
+		if old != nil && old.sameLayout(ntpl) {
+			ntpl.firstSeen = old.firstSeen
+		}
+		s.templates[key] = ntpl
+	} else {
+		// A template consisting only of zero length fields can't describe
+		// any data.
+		delete(s.templates, key)
+	}
+	s.mut.Unlock()
+
+	switch {
+	case old == nil && ntpl != nil:
+		s.templateEvent(TemplateAdded, key, nil, ntpl)
+	case old != nil && ntpl == nil:
+		s.templateEvent(TemplateWithdrawn, key, old, nil)
+	case old != nil && !old.sameLayout(ntpl):
+		s.templateEvent(TemplateChanged, key, old, ntpl)
+	}
+
+	if ntpl == nil || !s.withIDAliasing {
+		return key.templateID, err
+	}
+
+	if debug {
+		dl.Printf("Mapped template id %d/%d -> %d", key.domainID, key.templateID, ntpl.alias)
+	}
+	return ntpl.alias, nil
+}
+
+// aliasTemplate returns the virtual template ID for the template's layout,
+// allocating one if the layout hasn't been seen before, and takes a reference
+// to it. Virtual template IDs no longer referenced by any template are kept,
+// so that records already returned can still be interpreted, until the ID
+// space runs out; then the least recently released one is reused. It must be
+// called with s.mut held.
+func (s *Session) aliasTemplate(tpl *template) (uint16, error) {
+	hash := templateSignature(tpl.specifiers, tpl.scopeFields)
+	if id, ok := s.signatures[hash]; ok {
+		if s.aliasRefs[id] == 0 {
+			s.reviveAlias(id)
+		}
+		s.aliasRefs[id]++
+		return id, nil
+	}
+
+	var ntid uint16
+	switch {
+	case s.nextID < 65535:
+		ntid = s.nextID
+		s.nextID++
+	case len(s.freeAliases) > 0:
+		ntid = s.freeAliases[0]
+		s.freeAliases = s.freeAliases[1:]
+		old := s.virtual[ntid]
+		delete(s.signatures, templateSignature(old.specifiers, old.scopeFields))
+		if debug {
+			dl.Println("reusing virtual template id", ntid)
+		}
+	default:
+		return 0, ErrTemplateIDsExhausted
+	}
+
+	s.signatures[hash] = ntid
+	s.virtual[ntid] = &template{
+		specifiers:  tpl.specifiers,
+		scopeFields: tpl.scopeFields,
+		minRecord:   tpl.minRecord,
+		alias:       ntid,
+	}
+	s.aliasRefs[ntid]++
+
+	return ntid, nil
+}
+
+// releaseAlias drops a reference to the virtual template ID, making it
+// available for reuse when the last one is gone. It must be called with
+// s.mut held.
+func (s *Session) releaseAlias(id uint16) {
+	s.aliasRefs[id]--
+	if s.aliasRefs[id] > 0 {
+		return
+	}
+	delete(s.aliasRefs, id)
+	s.freeAliases = append(s.freeAliases, id)
+}
+
+// reviveAlias takes a released virtual template ID back into use. It must be
+// called with s.mut held.
+func (s *Session) reviveAlias(id uint16) {
+	for i, free := range s.freeAliases {
+		if free == id {
+			s.freeAliases = append(s.freeAliases[:i], s.freeAliases[i+1:]...)
+			return
+		}
+	}
+}
+
+// sameLayout returns true if the templates describe identical records.
+func (tpl *template) sameLayout(other *template) bool {
+	if tpl.scopeFields != other.scopeFields || tpl.alias != other.alias || len(tpl.specifiers) != len(other.specifiers) {
+		return false
+	}
+	for i := range tpl.specifiers {
+		if tpl.specifiers[i] != other.specifiers[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// templateSignature returns a hash identifying the template layout. Options
+// templates include the scope field count, so that they never share an alias
+// with an otherwise identical template.
+func templateSignature(tpl []TemplateFieldSpecifier, scopeFields uint16) [sha1.Size]byte {
+	var buffer bytes.Buffer
+	if scopeFields > 0 {
+		binary.Write(&buffer, binary.BigEndian, scopeFields)
+	}
+	binary.Write(&buffer, binary.BigEndian, tpl)
+	return sha1.Sum(buffer.Bytes())
+}
+
+// withdrawTemplate handles a withdrawal record as described in RFC 7011
+// section 8.1. A Template ID of 2 in a Template Set, or 3 in an Options
+// Template Set, withdraws all templates of that kind in the domain. Otherwise
+// the given template is withdrawn, provided it is of the right kind.
+func (s *Session) withdrawTemplate(domainID uint32, tid uint16, options bool) (TemplateWithdrawal, bool) {
+	w := TemplateWithdrawal{
+		TemplateID: tid,
+		Options:    options,
+		All:        tid == 2 && !options || tid == 3 && options,
+	}
+
+	if tid < 256 && !w.All {
+		// Not a valid template ID, so there is nothing to withdraw
+		if debug {
+			dl.Println("ignoring withdrawal of template", tid)
+		}
+		return w, false
+	}
+
+	removed := make(map[templateKey]*template)
+	s.mut.Lock()
+	if w.All {
+		for key, tpl := range s.templates {
+			if key.domainID == domainID && (tpl.scopeFields > 0) == options {
+				removed[key] = tpl
+				s.dropTemplate(key, tpl)
+			}
+		}
+	} else {
+		key := templateKey{domainID, tid}
+		if tpl, ok := s.templates[key]; ok && (tpl.scopeFields > 0) == options {
+			removed[key] = tpl
+			s.dropTemplate(key, tpl)
+		}
+	}
+	s.mut.Unlock()
+
+	for key, tpl := range removed {
+		s.templateEvent(TemplateWithdrawn, key, tpl, nil)
+	}
+
+	if debug {
+		dl.Printf("withdrawal: %+v", w)
+	}
+	return w, true
+}
+
+func calcMinRecLen(tpl []TemplateFieldSpecifier) uint16 {
+	var minLen uint16
+	for i := range tpl {
+		if tpl[i].Length == 65535 {
+			minLen++
+		} else {
+			minLen += tpl[i].Length
+		}
+	}
+	return minLen
+}
+
+// lookupTemplate returns the template the exporter uses for the given
+// template ID in the given domain, or nil.
+func (s *Session) lookupTemplate(key templateKey) *template {
+	s.mut.RLock()
+	tpl := s.templates[key]
+	s.mut.RUnlock()
+
+	if tpl != nil && s.isExpired(tpl, s.now()) {
+		// Expired but not yet removed; it's as good as unknown.
+		return nil
+	}
+	return tpl
+}
+
+func (s *Session) isExpired(tpl *template, now time.Time) bool {
+	return s.templateTimeout > 0 && now.Sub(tpl.lastSeen) > s.templateTimeout
+}
+
+// expire removes the templates that have not been refreshed within the
+// template timeout, and pending data sets that have waited too long for their
+// template. The scan is performed at most once per expiryInterval.
+func (s *Session) expire() {
+	if s.templateTimeout <= 0 && s.pending.timeout <= 0 {
+		return
+	}
+
+	now := s.now()
+	next := atomic.LoadInt64(&s.nextExpiry)
+	if now.UnixNano() < next || !atomic.CompareAndSwapInt64(&s.nextExpiry, next, now.Add(expiryInterval).UnixNano()) {
+		return
+	}
+
+	if s.pending.enabled() {
+		s.pending.expire(now)
+	}
+	s.expireTemplates(now)
+}
+
+func (s *Session) expireTemplates(now time.Time) {
+	if s.templateTimeout <= 0 {
+		return
+	}
+
+	removed := make(map[templateKey]*template)
+	s.mut.Lock()
+	for key, tpl := range s.templates {
+		if s.isExpired(tpl, now) {
+			if debug {
+				dl.Printf("expiring template %d/%d", key.domainID, key.templateID)
+			}
+			removed[key] = tpl
+			s.dropTemplate(key, tpl)
+		}
+	}
+	s.mut.Unlock()
+
+	for key, tpl := range removed {
+		s.templateEvent(TemplateExpired, key, tpl, nil)
+	}
+}
+
+// dropTemplate removes the template from the Session. It must be called with
+// s.mut held.
+func (s *Session) dropTemplate(key templateKey, tpl *template) {
+	delete(s.templates, key)
+	if s.withIDAliasing {
+		s.releaseAlias(tpl.alias)
+	}
+}
+
+// lookupRecordTemplate returns the template describing a DataRecord or
+// OptionsDataRecord returned by this Session, or nil. With ID aliasing the
+// records carry the virtual template ID, which is unique across domains.
+func (s *Session) lookupRecordTemplate(domainID uint32, tid uint16) *template {
+	if s.withIDAliasing {
+		s.mut.RLock()
+		defer s.mut.RUnlock()
+		return s.virtual[tid]
+	}
+	return s.lookupTemplate(templateKey{domainID, tid})
+}
+
+// TemplateInfo describes a template or options template currently held by a
+// Session.
+type TemplateInfo struct {
+	DomainID        uint32
+	TemplateID      uint16                   // The template ID used by the exporter
+	Alias           uint16                   // The virtual template ID, when ID aliasing is enabled
+	ScopeFieldCount uint16                   // Nonzero for options templates
+	FieldSpecifiers []TemplateFieldSpecifier // Scope fields first, for options templates
+	FirstSeen       time.Time                // When the current definition was first received
+	LastSeen        time.Time                // When the template was last received
+}
+
+// Templates returns the templates and options templates currently held by
+// the Session, ordered by domain and template ID. Expired templates are not
+// included.
+func (s *Session) Templates() []TemplateInfo {
+	now := s.now()
+
+	s.mut.RLock()
+	res := make([]TemplateInfo, 0, len(s.templates))
+	for key, tpl := range s.templates {
+		if !s.isExpired(tpl, now) {
+			res = append(res, tpl.info(key))
+		}
+	}
+	s.mut.RUnlock()
+
+	sort.Slice(res, func(a, b int) bool {
+		if res[a].DomainID != res[b].DomainID {
+			return res[a].DomainID < res[b].DomainID
+		}
+		return res[a].TemplateID < res[b].TemplateID
+	})
+	return res
+}
+
+// Template returns the template or options template with the given ID in the
+// given domain, and whether it exists.
+func (s *Session) Template(domainID uint32, templateID uint16) (TemplateInfo, bool) {
+	key := templateKey{domainID, templateID}
+	tpl := s.lookupTemplate(key)
+	if tpl == nil {
+		return TemplateInfo{}, false
+	}
+	return tpl.info(key), true
+}
+
+func (tpl *template) info(key templateKey) TemplateInfo {
+	fs := make([]TemplateFieldSpecifier, len(tpl.specifiers))
+	copy(fs, tpl.specifiers)
+	return TemplateInfo{
+		DomainID:        key.domainID,
+		TemplateID:      key.templateID,
+		Alias:           tpl.alias,
+		ScopeFieldCount: tpl.scopeFields,
+		FieldSpecifiers: fs,
+		FirstSeen:       tpl.firstSeen,
+		LastSeen:        tpl.lastSeen,
+	}
+}
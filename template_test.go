@@ -0,0 +1,289 @@
+package ipfix
+
+import (
+	"encoding/hex"
+	"errors"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestTemplateTimeout(t *testing.T) {
+	testTemplateTimeout(false, t)
+}
+
+func TestTemplateTimeoutWithAliasing(t *testing.T) {
+	testTemplateTimeout(true, t)
+}
+
+func testTemplateTimeout(withAliasing bool, t *testing.T) {
+	t1, _ := hex.DecodeString("000a0020000000000000000000000001000200100100000200080004000c0004")
+	d1, _ := hex.DecodeString("000a001c0000000000000000000000010100000c0a0000010a000002")
+
+	now := time.Date(2016, 1, 1, 0, 0, 0, 0, time.UTC)
+	s := NewSession(WithIDAliasing(withAliasing), WithTemplateTimeout(time.Minute))
+	s.now = func() time.Time { return now }
+
+	if _, err := s.ParseBuffer(t1); err != nil {
+		t.Fatal("ParseBuffer failed", err)
+	}
+
+	now = now.Add(59 * time.Second)
+	msg, err := s.ParseBuffer(d1)
+	if err != nil {
+		t.Fatal("ParseBuffer failed", err)
+	}
+	if len(msg.DataRecords) != 1 {
+		t.Error("Incorrect number of data records before expiry", len(msg.DataRecords))
+	}
+
+	now = now.Add(2 * time.Second)
+	msg, err = s.ParseBuffer(d1)
+	if err != nil {
+		t.Fatal("ParseBuffer failed", err)
+	}
+	if len(msg.DataRecords) != 0 {
+		t.Error("Incorrect number of data records after expiry", len(msg.DataRecords))
+	}
+	if len(s.templates) != 0 {
+		t.Error("Expired template was not removed")
+	}
+
+	// A refresh makes the template usable again
+	if _, err := s.ParseBuffer(t1); err != nil {
+		t.Fatal("ParseBuffer failed", err)
+	}
+	msg, err = s.ParseBuffer(d1)
+	if err != nil {
+		t.Fatal("ParseBuffer failed", err)
+	}
+	if len(msg.DataRecords) != 1 {
+		t.Error("Incorrect number of data records after refresh", len(msg.DataRecords))
+	}
+}
+
+func TestTemplateRedefinitionWithAliasing(t *testing.T) {
+	t1, _ := hex.DecodeString("000a0020000000000000000000000001000200100100000200080004000c0004")
+	t2, _ := hex.DecodeString("000a001c0000000000000000000000010002000c0100000100070002")
+	d2, _ := hex.DecodeString("000a00180000000000000000000000010100000800500051")
+
+	s := NewSession(WithIDAliasing(true))
+	for _, bs := range [][]byte{t1, t2} {
+		if _, err := s.ParseBuffer(bs); err != nil {
+			t.Fatal("ParseBuffer failed", err)
+		}
+	}
+
+	msg, err := s.ParseBuffer(d2)
+	if err != nil {
+		t.Fatal("ParseBuffer failed", err)
+	}
+	if len(msg.DataRecords) != 2 {
+		t.Error("Incorrect number of data records", len(msg.DataRecords))
+	}
+}
+
+func TestTemplateWithdrawal(t *testing.T) {
+	testTemplateWithdrawal(false, t)
+}
+
+func TestTemplateWithdrawalWithAliasing(t *testing.T) {
+	testTemplateWithdrawal(true, t)
+}
+
+func testTemplateWithdrawal(withAliasing bool, t *testing.T) {
+	// Templates 256 and 257 plus options template 258 in domain 1,
+	// template 256 in domain 2
+	t1, _ := hex.DecodeString("000a003600000000000000000000000100020014010000010008000401010001000c0004000300120102000200010095000400220004")
+	t2, _ := hex.DecodeString("000a001c0000000000000000000000020002000c0100000100080004")
+	// Withdraw template 256, all templates and all options templates in domain 1
+	w256, _ := hex.DecodeString("000a00180000000000000000000000010002000801000000")
+	wAll, _ := hex.DecodeString("000a00180000000000000000000000010002000800020000")
+	wAllOptions, _ := hex.DecodeString("000a00180000000000000000000000010003000800030000")
+
+	s := NewSession(WithIDAliasing(withAliasing))
+	for _, bs := range [][]byte{t1, t2} {
+		if _, err := s.ParseBuffer(bs); err != nil {
+			t.Fatal("ParseBuffer failed", err)
+		}
+	}
+
+	exists := func(domainID uint32, tid uint16) bool {
+		return s.lookupTemplate(templateKey{domainID, tid}) != nil
+	}
+
+	msg, err := s.ParseBuffer(w256)
+	if err != nil {
+		t.Fatal("ParseBuffer failed", err)
+	}
+	if len(msg.TemplateRecords) != 0 {
+		t.Error("Withdrawal reported as template record")
+	}
+	if exp := []TemplateWithdrawal{{TemplateID: 256}}; !reflect.DeepEqual(msg.Withdrawals, exp) {
+		t.Errorf("Incorrect withdrawals %+v != %+v", msg.Withdrawals, exp)
+	}
+	if exists(1, 256) || !exists(1, 257) || !exists(1, 258) || !exists(2, 256) {
+		t.Error("Incorrect templates after single withdrawal")
+	}
+
+	msg, err = s.ParseBuffer(wAll)
+	if err != nil {
+		t.Fatal("ParseBuffer failed", err)
+	}
+	if exp := []TemplateWithdrawal{{TemplateID: 2, All: true}}; !reflect.DeepEqual(msg.Withdrawals, exp) {
+		t.Errorf("Incorrect withdrawals %+v != %+v", msg.Withdrawals, exp)
+	}
+	if exists(1, 257) || !exists(1, 258) || !exists(2, 256) {
+		t.Error("Incorrect templates after withdrawing all templates")
+	}
+
+	msg, err = s.ParseBuffer(wAllOptions)
+	if err != nil {
+		t.Fatal("ParseBuffer failed", err)
+	}
+	if exp := []TemplateWithdrawal{{TemplateID: 3, Options: true, All: true}}; !reflect.DeepEqual(msg.Withdrawals, exp) {
+		t.Errorf("Incorrect withdrawals %+v != %+v", msg.Withdrawals, exp)
+	}
+	if exists(1, 258) || !exists(2, 256) {
+		t.Error("Incorrect templates after withdrawing all options templates")
+	}
+}
+
+func TestAliasReuse(t *testing.T) {
+	t1, _ := hex.DecodeString("000a0020000000000000000000000001000200100100000200080004000c0004")
+	t2, _ := hex.DecodeString("000a001c0000000000000000000000010002000c0100000100070002")
+	w256, _ := hex.DecodeString("000a00180000000000000000000000010002000801000000")
+
+	s := NewSession(WithIDAliasing(true))
+
+	msg, err := s.ParseBuffer(t1)
+	if err != nil {
+		t.Fatal("ParseBuffer failed", err)
+	}
+	id := msg.TemplateRecords[0].TemplateID
+
+	// A withdrawn layout keeps its ID until it is needed elsewhere
+	if _, err := s.ParseBuffer(w256); err != nil {
+		t.Fatal("ParseBuffer failed", err)
+	}
+	if len(s.freeAliases) != 1 {
+		t.Fatal("Incorrect number of free aliases", len(s.freeAliases))
+	}
+	msg, err = s.ParseBuffer(t1)
+	if err != nil {
+		t.Fatal("ParseBuffer failed", err)
+	}
+	if msg.TemplateRecords[0].TemplateID != id {
+		t.Errorf("Template alias changed from %d to %d", id, msg.TemplateRecords[0].TemplateID)
+	}
+	if len(s.freeAliases) != 0 || s.aliasRefs[id] != 1 {
+		t.Errorf("Alias %d not taken back into use", id)
+	}
+
+	// Out of fresh IDs, the redefinition reuses the ID released by the old
+	// layout of the same template.
+	s.nextID = 65535
+	msg, err = s.ParseBuffer(t2)
+	if err != nil {
+		t.Fatal("ParseBuffer failed", err)
+	}
+	if msg.TemplateRecords[0].TemplateID != id {
+		t.Errorf("Incorrect template alias %d, expected %d", msg.TemplateRecords[0].TemplateID, id)
+	}
+	if len(s.signatures) != 1 || len(s.virtual) != 1 {
+		t.Errorf("Old layout not forgotten, %d signatures, %d virtual templates", len(s.signatures), len(s.virtual))
+	}
+}
+
+func TestAliasExhaustion(t *testing.T) {
+	t1, _ := hex.DecodeString("000a0020000000000000000000000001000200100100000200080004000c0004")
+	t2, _ := hex.DecodeString("000a001c0000000000000000000000020002000c0100000100070002")
+
+	s := NewSession(WithIDAliasing(true))
+	s.nextID = 65534
+
+	msg, err := s.ParseBuffer(t1)
+	if err != nil {
+		t.Fatal("ParseBuffer failed", err)
+	}
+	if msg.TemplateRecords[0].TemplateID != 65534 {
+		t.Error("Incorrect template alias", msg.TemplateRecords[0].TemplateID)
+	}
+
+	_, err = s.ParseBuffer(t2)
+	if !errors.Is(err, ErrTemplateIDsExhausted) {
+		t.Fatalf("Received %v instead of ErrTemplateIDsExhausted", err)
+	}
+	if s.lookupTemplate(templateKey{2, 256}) != nil {
+		t.Error("Template registered without alias")
+	}
+}
+
+func TestTemplateInspection(t *testing.T) {
+	t1, _ := hex.DecodeString("000a0020000000000000000000000001000200100100000200080004000c0004")
+	t2, _ := hex.DecodeString("000a001c0000000000000000000000010002000c0100000100070002")
+	o1, _ := hex.DecodeString("000a003800000000000000000000000100030018010000030001009500040022000400230001000001000010000000010000006401000000")
+
+	now := time.Date(2016, 1, 1, 0, 0, 0, 0, time.UTC)
+	start := now
+	s := NewSession(WithIDAliasing(true))
+	s.now = func() time.Time { return now }
+
+	if _, err := s.ParseBuffer(t1); err != nil {
+		t.Fatal("ParseBuffer failed", err)
+	}
+	now = now.Add(time.Minute)
+	if _, err := s.ParseBuffer(t1); err != nil {
+		t.Fatal("ParseBuffer failed", err)
+	}
+
+	info, ok := s.Template(1, 256)
+	if !ok {
+		t.Fatal("Template not found")
+	}
+	exp := TemplateInfo{
+		DomainID:        1,
+		TemplateID:      256,
+		Alias:           256,
+		FieldSpecifiers: []TemplateFieldSpecifier{{FieldID: 8, Length: 4}, {FieldID: 12, Length: 4}},
+		FirstSeen:       start,
+		LastSeen:        now,
+	}
+	if !reflect.DeepEqual(info, exp) {
+		t.Errorf("Incorrect template info\n%+v, expected\n%+v", info, exp)
+	}
+
+	// The returned specifiers are a copy
+	info.FieldSpecifiers[0].FieldID = 7
+	if info, _ := s.Template(1, 256); info.FieldSpecifiers[0].FieldID != 8 {
+		t.Error("Template modified through TemplateInfo")
+	}
+
+	i := NewInterpreter(s)
+	fs := i.InterpretTemplateInfo(info)
+	if len(fs) != 2 || fs[1].Name != "destinationIPv4Address" {
+		t.Errorf("Incorrect interpreted template %+v", fs)
+	}
+
+	// A redefinition resets the first seen time
+	now = now.Add(time.Minute)
+	if _, err := s.ParseBuffer(t2); err != nil {
+		t.Fatal("ParseBuffer failed", err)
+	}
+	if info, _ := s.Template(1, 256); !info.FirstSeen.Equal(now) || info.Alias != 257 {
+		t.Errorf("Incorrect template info after redefinition %+v", info)
+	}
+
+	// Options templates are included
+	if _, err := s.ParseBuffer(o1); err != nil {
+		t.Fatal("ParseBuffer failed", err)
+	}
+	infos := s.Templates()
+	if len(infos) != 1 || infos[0].ScopeFieldCount != 1 {
+		t.Errorf("Incorrect templates %+v", infos)
+	}
+
+	if _, ok := s.Template(1, 257); ok {
+		t.Error("Unexpected template 257")
+	}
+}
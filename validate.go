@@ -0,0 +1,155 @@
+package ipfix
+
+import "fmt"
+
+// TemplateValidation selects what the Session does with templates that break
+// the rules of RFC 7011 or don't match the dictionary.
+type TemplateValidation int
+
+const (
+	// ValidateOff accepts all templates as they are. This is the default.
+	ValidateOff TemplateValidation = iota
+	// ValidateWarn accepts all templates, but reports the violations in
+	// Message.TemplateViolations.
+	ValidateWarn
+	// ValidateReject reports the violations and drops the offending
+	// templates. Data sets using them are treated as having an unknown
+	// template.
+	ValidateReject
+)
+
+// WithTemplateValidation sets how templates are validated.
+func WithTemplateValidation(v TemplateValidation) Option {
+	return func(s *Session) {
+		s.validation = v
+	}
+}
+
+// A TemplateViolation describes a problem with a template or one of its field
+// specifiers.
+type TemplateViolation struct {
+	DomainID   uint32
+	TemplateID uint16
+	Field      int // Index of the field specifier, with any scope fields first, or -1 for the template itself
+	Specifier  TemplateFieldSpecifier
+	Reason     string
+}
+
+func (v TemplateViolation) Error() string {
+	if v.Field < 0 {
+		return fmt.Sprintf("template %d/%d: %s", v.DomainID, v.TemplateID, v.Reason)
+	}
+	return fmt.Sprintf("template %d/%d field %d (%d/%d): %s", v.DomainID, v.TemplateID, v.Field, v.Specifier.EnterpriseID, v.Specifier.FieldID, v.Reason)
+}
+
+// maxLength is the maximum length of a field of the given type, in bytes, or
+// zero if there is no limit other than the one imposed by the encoding.
+func (t FieldType) maxLength() int {
+	switch t {
+	case Uint8, Int8, Boolean:
+		return 1
+	case Uint16, Int16:
+		return 2
+	case Uint32, Int32, Float32, DateTimeSeconds, Ipv4Address:
+		return 4
+	case Uint64, Int64, Float64, DateTimeMilliseconds, DateTimeMicroseconds, DateTimeNanoseconds:
+		return 8
+	case MacAddress:
+		return 6
+	case Ipv6Address:
+		return 16
+	default:
+		return 0
+	}
+}
+
+// validateTemplate checks the template against RFC 7011 and the types in the
+// builtin dictionary, returning the violations found.
+func validateTemplate(domainID uint32, templateID uint16, tpl []TemplateFieldSpecifier) []TemplateViolation {
+	var res []TemplateViolation
+	violation := func(field int, reason string, args ...interface{}) {
+		v := TemplateViolation{
+			DomainID:   domainID,
+			TemplateID: templateID,
+			Field:      field,
+			Reason:     fmt.Sprintf(reason, args...),
+		}
+		if field >= 0 {
+			v.Specifier = tpl[field]
+		}
+		res = append(res, v)
+	}
+
+	if templateID < 256 {
+		violation(-1, "template ID %d is reserved", templateID)
+	}
+
+	for i, f := range tpl {
+		if f.EnterpriseID == 0 && f.FieldID == 0 {
+			violation(i, "information element 0 is reserved")
+		}
+		if f.Length == 0 {
+			violation(i, "zero length field")
+			continue
+		}
+
+		entry, ok := builtinDictionary[dictionaryKey{f.EnterpriseID, f.FieldID}]
+		if !ok {
+			continue
+		}
+		min, max := entry.Type.minLength(), entry.Type.maxLength()
+		switch {
+		case f.Length == 65535 && max > 0:
+			violation(i, "variable length not allowed for %s", entry.Name)
+		case f.Length == 65535:
+		case int(f.Length) < min || max > 0 && int(f.Length) > max:
+			violation(i, "length %d not allowed for %s", f.Length, entry.Name)
+		case entry.Type == Float64 && f.Length != 4 && f.Length != 8:
+			// Reduced-size encoding of float64 is as float32 only
+			violation(i, "length %d not allowed for %s", f.Length, entry.Name)
+		}
+	}
+
+	return res
+}
+
+// checkTemplate validates the template according to the Session's setting,
+// adding any violations to the message. It returns false if the template
+// should be dropped, in which case any previous definition is removed as
+// well.
+func (s *Session) checkTemplate(tpl []TemplateFieldSpecifier, templateID uint16, msg *Message) bool {
+	if s.validation == ValidateOff {
+		return true
+	}
+
+	vs := validateTemplate(msg.Header.DomainID, templateID, tpl)
+	if len(vs) == 0 {
+		return true
+	}
+
+	if debug {
+		for _, v := range vs {
+			dl.Println(v)
+		}
+	}
+	msg.TemplateViolations = append(msg.TemplateViolations, vs...)
+
+	if s.validation != ValidateReject {
+		return true
+	}
+	s.rejectTemplate(templateKey{msg.Header.DomainID, templateID})
+	return false
+}
+
+// rejectTemplate removes the previous definition of a template that failed
+// validation.
+func (s *Session) rejectTemplate(key templateKey) {
+	s.mut.Lock()
+	old := s.templates[key]
+	if old != nil {
+		s.dropTemplate(key, old)
+	}
+	s.mut.Unlock()
+
+	s.templateEvent(TemplateRejected, key, old, nil)
+}
@@ -0,0 +1,134 @@
+package ipfix_test
+
+import (
+	"encoding/hex"
+	"reflect"
+	"testing"
+
+	"github.com/calmh/ipfix"
+)
+
+// Template 256 with a three byte sourceIPv4Address, the reserved information
+// element 0, a zero length destinationIPv4Address and a protocolIdentifier,
+// followed by a data set.
+var invalidTemplatePacket = "000a003400000000000000000000000100020018010000040008000300000004000c0000000400010100000c0001020304050607"
+
+func TestTemplateValidationOff(t *testing.T) {
+	packet, _ := hex.DecodeString(invalidTemplatePacket)
+
+	p := ipfix.NewSession()
+	msg, err := p.ParseBuffer(packet)
+	if err != nil {
+		t.Fatal("ParseBuffer failed", err)
+	}
+	if len(msg.TemplateViolations) != 0 {
+		t.Error("Unexpected violations", msg.TemplateViolations)
+	}
+	if len(msg.DataRecords) != 1 {
+		t.Error("Incorrect number of data records", len(msg.DataRecords))
+	}
+}
+
+func TestTemplateValidationWarn(t *testing.T) {
+	packet, _ := hex.DecodeString(invalidTemplatePacket)
+
+	p := ipfix.NewSession(ipfix.WithTemplateValidation(ipfix.ValidateWarn))
+	msg, err := p.ParseBuffer(packet)
+	if err != nil {
+		t.Fatal("ParseBuffer failed", err)
+	}
+	if len(msg.TemplateRecords) != 1 || len(msg.DataRecords) != 1 {
+		t.Errorf("Incorrect number of template %d or data records %d", len(msg.TemplateRecords), len(msg.DataRecords))
+	}
+
+	if len(msg.TemplateViolations) != 3 {
+		t.Fatal("Incorrect number of violations", len(msg.TemplateViolations))
+	}
+	for i, v := range msg.TemplateViolations {
+		if v.DomainID != 1 || v.TemplateID != 256 || v.Field != i {
+			t.Errorf("Incorrect violation %d: %v", i, v)
+		}
+	}
+	if v := msg.TemplateViolations[0]; v.Specifier.FieldID != 8 || v.Specifier.Length != 3 {
+		t.Errorf("Incorrect specifier %+v", v.Specifier)
+	}
+}
+
+func TestTemplateValidationReject(t *testing.T) {
+	packet, _ := hex.DecodeString(invalidTemplatePacket)
+	valid, _ := hex.DecodeString("000a0020000000000000000000000001000200100100000200080004000c0004")
+
+	var events []ipfix.TemplateEventKind
+	hook := func(ev ipfix.TemplateEvent) {
+		events = append(events, ev.Kind)
+	}
+
+	p := ipfix.NewSession(ipfix.WithTemplateValidation(ipfix.ValidateReject), ipfix.WithTemplateHook(hook))
+	msg, err := p.ParseBuffer(valid)
+	if err != nil {
+		t.Fatal("ParseBuffer failed", err)
+	}
+	if len(msg.TemplateViolations) != 0 || len(msg.TemplateRecords) != 1 {
+		t.Fatal("Valid template not accepted", msg.TemplateViolations)
+	}
+
+	// The invalid template replaces the valid one, so neither is used
+	msg, err = p.ParseBuffer(packet)
+	if err != nil {
+		t.Fatal("ParseBuffer failed", err)
+	}
+	if len(msg.TemplateViolations) != 3 {
+		t.Error("Incorrect number of violations", len(msg.TemplateViolations))
+	}
+	if len(msg.TemplateRecords) != 0 || len(msg.DataRecords) != 0 {
+		t.Errorf("Incorrect number of template %d or data records %d", len(msg.TemplateRecords), len(msg.DataRecords))
+	}
+
+	// Rejection is not reported as a withdrawal
+	exp := []ipfix.TemplateEventKind{ipfix.TemplateAdded, ipfix.TemplateRejected}
+	if !reflect.DeepEqual(events, exp) {
+		t.Errorf("Incorrect events %v != %v", events, exp)
+	}
+}
+
+func TestTemplateValidationCursor(t *testing.T) {
+	packet, _ := hex.DecodeString(invalidTemplatePacket)
+
+	p := ipfix.NewSession(ipfix.WithTemplateValidation(ipfix.ValidateWarn))
+	c := p.Records(packet)
+	for c.Next() {
+	}
+	if err := c.Err(); err != nil {
+		t.Fatal("Cursor failed", err)
+	}
+	if len(c.TemplateViolations()) != 3 {
+		t.Error("Incorrect number of violations", len(c.TemplateViolations()))
+	}
+
+	// Violations are per message
+	c.Reset(packet)
+	if err := c.Finish(); err != nil {
+		t.Fatal("Finish failed", err)
+	}
+	if len(c.TemplateViolations()) != 3 {
+		t.Error("Incorrect number of violations", len(c.TemplateViolations()))
+	}
+}
+
+func TestTemplateValidationFloat64(t *testing.T) {
+	// Template 256 with absoluteError (float64) in four, six and eight bytes.
+	// Only the six byte encoding is invalid.
+	packet, _ := hex.DecodeString("000a00240000000000000000000000010002001401000003014000040140000601400008")
+
+	p := ipfix.NewSession(ipfix.WithTemplateValidation(ipfix.ValidateWarn))
+	msg, err := p.ParseBuffer(packet)
+	if err != nil {
+		t.Fatal("ParseBuffer failed", err)
+	}
+	if len(msg.TemplateViolations) != 1 {
+		t.Fatal("Incorrect number of violations", len(msg.TemplateViolations))
+	}
+	if v := msg.TemplateViolations[0]; v.Field != 1 || v.Specifier.Length != 6 {
+		t.Errorf("Incorrect violation %v", v)
+	}
+}